@@ -0,0 +1,171 @@
+package prom
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultAdaptiveBackoff is the factor by which AdaptiveConcurrency reduces the
+// concurrency limit after a failure
+const DefaultAdaptiveBackoff = 0.5
+
+// AdaptiveConcurrency is an AIMD (additive increase, multiplicative decrease)
+// controller for the concurrency of a Context. Once a full limit's worth of
+// queries in a row have succeeded within TargetLatency, the limit is raised by
+// one; any other failure restarts the count.
+// When a query times out, or Prometheus responds with a 5xx or 429, the limit
+// is multiplied by Backoff. The limit is always kept within [Min, Max].
+type AdaptiveConcurrency struct {
+	Min           int
+	Max           int
+	TargetLatency time.Duration
+	Backoff       float64
+
+	m            sync.Mutex
+	limit        int
+	successes    int
+	lastDecrease time.Time
+}
+
+// NewAdaptiveConcurrency creates a new AdaptiveConcurrency controller which
+// keeps the concurrency limit between min and max, increasing it while queries
+// complete within the target latency.
+func NewAdaptiveConcurrency(min, max int, targetLatency time.Duration) *AdaptiveConcurrency {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+
+	return &AdaptiveConcurrency{
+		Min:           min,
+		Max:           max,
+		TargetLatency: targetLatency,
+		Backoff:       DefaultAdaptiveBackoff,
+	}
+}
+
+// Limit returns the current concurrency limit
+func (ac *AdaptiveConcurrency) Limit() int {
+	ac.m.Lock()
+	defer ac.m.Unlock()
+
+	return ac.limit
+}
+
+// SetAdaptiveConcurrency enables adaptive control of the Context's concurrency,
+// starting from the current max concurrency clamped to the controller's
+// bounds. Passing nil disables adaptive control, leaving the current limit in
+// place. It should be called before queries are run.
+func (ctx *Context) SetAdaptiveConcurrency(ac *AdaptiveConcurrency) {
+	ctx.adaptive = ac
+	if ac == nil {
+		return
+	}
+
+	ac.m.Lock()
+	ac.limit = clampInt(ctx.MaxConcurrency(), ac.Min, ac.Max)
+	ac.successes = 0
+	limit := ac.limit
+	ac.m.Unlock()
+
+	ctx.SetMaxConcurrency(limit)
+}
+
+// observe reports the outcome of a request started at the given time to the
+// adaptive controller, if any, applying any resulting change in limit
+func (ctx *Context) observe(start time.Time, resp *http.Response, err error) {
+	ac := ctx.adaptive
+	if ac == nil {
+		return
+	}
+
+	// The Prometheus client reports error statuses in the response, not err
+	failed := err != nil || (resp != nil && resp.StatusCode >= 400)
+
+	limit, changed := ac.observe(start, time.Since(start), isOverloaded(resp, err), failed)
+	if changed {
+		ctx.SetMaxConcurrency(limit)
+	}
+}
+
+// observe records a single request outcome, returning the new limit and
+// whether or not it changed. Failures which are not overloads leave the limit
+// as is, but still restart the run of successes needed to raise it.
+func (ac *AdaptiveConcurrency) observe(start time.Time, latency time.Duration, overloaded bool, failed bool) (int, bool) {
+	ac.m.Lock()
+	defer ac.m.Unlock()
+
+	if overloaded {
+		// Requests already in flight at the last decrease were issued under
+		// the old limit, so they shouldn't compound it
+		if start.Before(ac.lastDecrease) {
+			return ac.limit, false
+		}
+
+		backoff := ac.Backoff
+		if backoff <= 0 || backoff >= 1 {
+			backoff = DefaultAdaptiveBackoff
+		}
+
+		limit := clampInt(int(float64(ac.limit)*backoff), ac.Min, ac.Max)
+		ac.successes = 0
+		ac.lastDecrease = time.Now()
+		if limit == ac.limit {
+			return ac.limit, false
+		}
+
+		ac.limit = limit
+		return ac.limit, true
+	}
+
+	if failed || (ac.TargetLatency > 0 && latency > ac.TargetLatency) {
+		ac.successes = 0
+		return ac.limit, false
+	}
+
+	ac.successes++
+	if ac.successes < ac.limit || ac.limit >= ac.Max {
+		return ac.limit, false
+	}
+
+	ac.successes = 0
+	ac.limit++
+	return ac.limit, true
+}
+
+// isOverloaded returns true if the response or error indicates that the
+// backend is failing to keep up; i.e. a timeout, a 5xx, or a 429
+func isOverloaded(resp *http.Response, err error) bool {
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return true
+		}
+
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return true
+		}
+	}
+
+	if resp != nil {
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	}
+
+	return false
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
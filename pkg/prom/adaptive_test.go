@@ -0,0 +1,30 @@
+package prom_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kubecost/cost-model/pkg/prom"
+	"github.com/kubecost/cost-model/pkg/prom/promtest"
+)
+
+func TestAdaptiveConcurrencyIgnoresClientErrors(t *testing.T) {
+	ctx, c := promtest.NewContext()
+	ctx.SetMaxConcurrency(1)
+	ac := prom.NewAdaptiveConcurrency(1, 10, time.Second)
+	ctx.SetAdaptiveConcurrency(ac)
+
+	c.RespondPromError("bad", 400, "bad_data", "parse error")
+	for i := 0; i < 5; i++ {
+		ctx.Query("bad").AwaitResults()
+	}
+	if ac.Limit() != 1 {
+		t.Errorf("expected 4xx responses not to raise the limit; got %d", ac.Limit())
+	}
+
+	c.RespondJSON("up", promtest.EmptyVector)
+	ctx.Query("up").AwaitResults()
+	if ac.Limit() != 2 {
+		t.Errorf("expected a success to raise the limit to 2; got %d", ac.Limit())
+	}
+}
@@ -0,0 +1,176 @@
+package prom
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/kubecost/cost-model/pkg/util"
+)
+
+// WeightedAverage returns the average of the latest value of each series,
+// weighted by the numeric value of the given label on that series. Series
+// without values are ignored, as are those whose weight label is NaN.
+// An error is returned if a weight label is missing or non-numeric, or if the
+// total weight is zero.
+//
+// NewQueryResults parses NaN and Inf values as zero, so such series are not
+// ignored, but averaged in as zero at their full weight, biasing the average
+// towards zero. Filter them in the query (e.g. with "x == x") to exclude them.
+func (qr *QueryResults) WeightedAverage(weightLabel string) (float64, error) {
+	var sum, totalWeight float64
+
+	for _, result := range qr.Results {
+		v, ok := latestValue(result.Values)
+		if !ok {
+			continue
+		}
+
+		ws, err := result.GetString(weightLabel)
+		if err != nil {
+			return 0, err
+		}
+		w, err := strconv.ParseFloat(ws, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s field is not numeric: %s", weightLabel, err)
+		}
+
+		if math.IsNaN(v) || math.IsNaN(w) {
+			continue
+		}
+
+		sum += v * w
+		totalWeight += w
+	}
+
+	if totalWeight == 0 {
+		return 0, fmt.Errorf("Cannot compute weighted average of query %s: total weight is zero", qr.Query)
+	}
+
+	return sum / totalWeight, nil
+}
+
+// WeightedAverageBy returns the average of the latest value of each series,
+// weighted by the latest value of the series in weights with matching values
+// for the given labels. Series without values, or without a matching weight,
+// are ignored. An error is returned if the total weight is zero.
+//
+// As NewQueryResults parses NaN and Inf values as zero, a NaN weight ignores
+// its series, but a NaN value is averaged in as zero at its full weight,
+// biasing the average towards zero, as for WeightedAverage.
+func (qr *QueryResults) WeightedAverageBy(weights *QueryResults, on []string) (float64, error) {
+	weightsByKey := make(map[string]float64, len(weights.Results))
+	for _, result := range weights.Results {
+		w, ok := latestValue(result.Values)
+		if !ok {
+			continue
+		}
+		weightsByKey[labelsKeyOn(result.Metric, on)] = w
+	}
+
+	var sum, totalWeight float64
+
+	for _, result := range qr.Results {
+		v, ok := latestValue(result.Values)
+		if !ok {
+			continue
+		}
+
+		w, ok := weightsByKey[labelsKeyOn(result.Metric, on)]
+		if !ok {
+			continue
+		}
+
+		if math.IsNaN(v) || math.IsNaN(w) {
+			continue
+		}
+
+		sum += v * w
+		totalWeight += w
+	}
+
+	if totalWeight == 0 {
+		return 0, fmt.Errorf("Cannot compute weighted average of query %s by query %s: total weight is zero", qr.Query, weights.Query)
+	}
+
+	return sum / totalWeight, nil
+}
+
+// latestValue returns the value of the vector with the latest timestamp
+func latestValue(vs []*util.Vector) (float64, bool) {
+	if len(vs) == 0 {
+		return 0, false
+	}
+
+	return latestVector(vs).Value, true
+}
+
+// latestVector returns the vector with the latest timestamp, of which there
+// must be at least one
+func latestVector(vs []*util.Vector) *util.Vector {
+	latest := vs[0]
+	for _, v := range vs[1:] {
+		if v.Timestamp > latest.Timestamp {
+			latest = v
+		}
+	}
+
+	return latest
+}
+
+// labelsKeyOn returns a string which uniquely identifies the values of the
+// given labels in the label set
+func labelsKeyOn(metric map[string]interface{}, on []string) string {
+	subset := make(map[string]interface{}, len(on))
+	for _, label := range on {
+		if v, ok := metric[label]; ok {
+			subset[label] = v
+		}
+	}
+
+	return labelsKey(subset)
+}
+
+// Round returns a copy of the results with every value rounded to the given
+// number of decimal places, half away from zero; e.g. 12.340000000002 to 12.34
+// for two places. Negative places round to tens, hundreds, etc. NaN and
+// infinite values are unchanged. Rounding is for presenting values only, and
+// should be applied after any arithmetic on them, so that rounding errors do
+// not accumulate.
+func (qr *QueryResults) Round(places int) *QueryResults {
+	rounded := qr.withResults(make([]*QueryResult, 0, len(qr.Results)))
+
+	scale := math.Pow(10, float64(places))
+
+	for _, result := range qr.Results {
+		values := make([]*util.Vector, len(result.Values))
+		for i, v := range result.Values {
+			values[i] = &util.Vector{
+				Timestamp: v.Timestamp,
+				Value:     roundValue(v.Value, scale),
+			}
+		}
+
+		rounded.Results = append(rounded.Results, &QueryResult{
+			Metric: result.Metric,
+			Values: values,
+		})
+	}
+
+	return rounded
+}
+
+// roundValue rounds the value to a multiple of 1/scale
+func roundValue(v float64, scale float64) float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return v
+	}
+
+	// Values too large to scale are already more precise than requested
+	r := math.Round(v*scale) / scale
+	if math.IsInf(r, 0) || math.IsNaN(r) {
+		return v
+	}
+
+	return r
+}
@@ -0,0 +1,71 @@
+package prom
+
+import (
+	"context"
+	"sync"
+)
+
+// inflightQueries tracks the cancel functions of the queries running on a
+// Context, so that they can be canceled together. Queries are tracked as soon
+// as they are issued, before their goroutines start, so that none issued
+// before a call to cancelAll can escape it.
+type inflightQueries struct {
+	m       sync.Mutex
+	next    uint64
+	cancels map[uint64]context.CancelFunc
+}
+
+// track returns a context derived from reqCtx which is canceled by CancelAll,
+// and a function which must be called once the query completes
+func (iq *inflightQueries) track(reqCtx context.Context) (context.Context, func()) {
+	c, cancel := context.WithCancel(reqCtx)
+
+	iq.m.Lock()
+	if iq.cancels == nil {
+		iq.cancels = map[uint64]context.CancelFunc{}
+	}
+	id := iq.next
+	iq.next++
+	iq.cancels[id] = cancel
+	iq.m.Unlock()
+
+	return c, func() {
+		iq.m.Lock()
+		delete(iq.cancels, id)
+		iq.m.Unlock()
+
+		cancel()
+	}
+}
+
+// cancelAll cancels every tracked query
+func (iq *inflightQueries) cancelAll() {
+	iq.m.Lock()
+	cancels := iq.cancels
+	iq.cancels = nil
+	iq.m.Unlock()
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
+
+// canceledResults returns the results of a query canceled with the given
+// error before it started
+func canceledResults(query string, err error) *QueryResults {
+	return &QueryResults{
+		Query: query,
+		Error: &QueryError{Query: query, Err: &CanceledError{Query: query, Err: err}},
+	}
+}
+
+// CancelAll cancels every query issued on the Context which is yet to
+// complete, whether waiting to start, waiting for access or running, without
+// waiting for them to stop. Their channels receive results with a QueryError
+// wrapping a CanceledError, as for QueryContext. This includes queries of a
+// QueryAll or QueryAllStream batch which are yet to start. Queries issued
+// after CancelAll returns run as normal. It is safe to call at any time, and
+// more than once.
+func (ctx *Context) CancelAll() {
+	ctx.inflight.cancelAll()
+}
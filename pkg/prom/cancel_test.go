@@ -0,0 +1,87 @@
+package prom_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/kubecost/cost-model/pkg/prom"
+	"github.com/kubecost/cost-model/pkg/prom/promtest"
+	prometheus "github.com/prometheus/client_golang/api"
+)
+
+// blockingClient blocks every request until its context is done
+type blockingClient struct {
+	urls *promtest.Client
+}
+
+func (bc blockingClient) URL(ep string, args map[string]string) *url.URL {
+	return bc.urls.URL(ep, args)
+}
+
+func (bc blockingClient) Do(ctx context.Context, req *http.Request) (*http.Response, []byte, prometheus.Warnings, error) {
+	<-ctx.Done()
+	return nil, nil, nil, ctx.Err()
+}
+
+func expectCanceled(t *testing.T, qr *prom.QueryResults) {
+	t.Helper()
+
+	var ce *prom.CanceledError
+	if !errors.As(qr.Error, &ce) {
+		t.Errorf("expected CanceledError for query %s; got %v", qr.Query, qr.Error)
+	}
+}
+
+func TestCancelAllImmediatelyAfterQuery(t *testing.T) {
+	ctx := prom.NewContext(blockingClient{promtest.NewClient()})
+
+	for i := 0; i < 200; i++ {
+		ch := ctx.Query("up")
+		ctx.CancelAll()
+		expectCanceled(t, ch.AwaitResults())
+	}
+}
+
+func TestCancelAllQueryAllBatch(t *testing.T) {
+	ctx := prom.NewContext(blockingClient{promtest.NewClient()})
+	ctx.QueryAllBatchSize = 1
+
+	chs := ctx.QueryAll("a", "b", "c")
+	ctx.CancelAll()
+
+	for _, ch := range chs {
+		expectCanceled(t, ch.AwaitResults())
+	}
+}
+
+func TestCancelAllQueryAllStream(t *testing.T) {
+	ctx := prom.NewContext(blockingClient{promtest.NewClient()})
+	ctx.QueryAllBatchSize = 1
+
+	out := ctx.QueryAllStream(context.Background(), map[string]string{"a": "a", "b": "b", "c": "c"})
+	ctx.CancelAll()
+
+	n := 0
+	for res := range out {
+		n++
+		expectCanceled(t, res.Results)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 results; got %d", n)
+	}
+}
+
+func TestQueryAfterCancelAll(t *testing.T) {
+	ctx, c := promtest.NewContext()
+	c.RespondJSON("up", promtest.EmptyVector)
+
+	ctx.CancelAll()
+
+	qr := ctx.Query("up").AwaitResults()
+	if qr.Error != nil {
+		t.Errorf("unexpected error: %s", qr.Error)
+	}
+}
@@ -0,0 +1,200 @@
+package prom
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kubecost/cost-model/pkg/util"
+)
+
+// ArithOp is an arithmetic operation applied to matched series by Combine
+type ArithOp string
+
+const (
+	ArithAdd ArithOp = "+"
+	ArithSub ArithOp = "-"
+	ArithMul ArithOp = "*"
+	ArithDiv ArithOp = "/"
+)
+
+// validate returns an error if the operation is not one of the ArithOps
+func (op ArithOp) validate() error {
+	switch op {
+	case ArithAdd, ArithSub, ArithMul, ArithDiv:
+		return nil
+	}
+
+	return fmt.Errorf("unknown arithmetic operation '%s'", op)
+}
+
+// apply returns the result of the operation on x and y. Division by zero
+// follows floating point semantics, as in PromQL; i.e. yields ±Inf or NaN.
+func (op ArithOp) apply(x, y float64) (float64, error) {
+	switch op {
+	case ArithAdd:
+		return x + y, nil
+	case ArithSub:
+		return x - y, nil
+	case ArithMul:
+		return x * y, nil
+	case ArithDiv:
+		return x / y, nil
+	}
+
+	return 0, fmt.Errorf("unknown arithmetic operation '%s'", op)
+}
+
+// maxUnmatchedReported caps the number of unmatched series named in an error
+const maxUnmatchedReported = 5
+
+// Combine applies the operation to the latest values of the series of a and b
+// with one-to-one matching, as PromQL does for a op on(labels) b, and returns
+// the resulting series; e.g. to multiply prices by usage. Series are matched
+// by the values of the given labels, or if none are given, of all labels
+// except __name__. The resulting series carry the matched labels of the
+// series of a, and the timestamp of its latest value. Series without values
+// are ignored.
+//
+// Unlike PromQL, which silently drops them, series of either a or b without a
+// match are an error, as is more than one series on either side sharing the
+// same match, either of a and b having failed, or an unknown operation.
+func Combine(a, b *QueryResults, op ArithOp, on []string) (*QueryResults, error) {
+	return combine(a, b, op, on, false)
+}
+
+// CombineIgnoring behaves like Combine, but matches series as PromQL does for
+// a op ignoring(labels) b; i.e. by the values of all labels except __name__
+// and the given labels, which the resulting series do not carry.
+func CombineIgnoring(a, b *QueryResults, op ArithOp, ignoring []string) (*QueryResults, error) {
+	return combine(a, b, op, ignoring, true)
+}
+
+// combine implements Combine and CombineIgnoring, matching series on the given
+// labels, or if ignoring is set, on all other labels
+func combine(a, b *QueryResults, op ArithOp, labels []string, ignoring bool) (*QueryResults, error) {
+	err := op.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if a.Error != nil {
+		return nil, a.Error
+	}
+	if b.Error != nil {
+		return nil, b.Error
+	}
+
+	// matches returns true if the label is one of those series are matched on,
+	// and so which the resulting series carry
+	matches := func(label string) bool {
+		if label == metricNameLabel {
+			return false
+		}
+		if ignoring {
+			return !containsString(labels, label)
+		}
+		return len(labels) == 0 || containsString(labels, label)
+	}
+
+	matchKey := func(metric map[string]interface{}) string {
+		if !ignoring && len(labels) > 0 {
+			return labelsKeyOn(metric, labels)
+		}
+
+		subset := make(map[string]interface{}, len(metric))
+		for k, v := range metric {
+			if matches(k) {
+				subset[k] = v
+			}
+		}
+		return labelsKey(subset)
+	}
+
+	right := make(map[string]*QueryResult, len(b.Results))
+	for _, result := range b.Results {
+		if len(result.Values) == 0 {
+			continue
+		}
+
+		key := matchKey(result.Metric)
+		if _, ok := right[key]; ok {
+			return nil, fmt.Errorf("multiple series match {%s} in query %s", strings.TrimSuffix(key, ","), b.Query)
+		}
+		right[key] = result
+	}
+
+	combined := &QueryResults{
+		Query:   fmt.Sprintf("(%s) %s (%s)", a.Query, op, b.Query),
+		Results: []*QueryResult{},
+	}
+
+	matched := map[string]bool{}
+	unmatched := []string{}
+
+	for _, result := range a.Results {
+		x, ok := latestValue(result.Values)
+		if !ok {
+			continue
+		}
+
+		key := matchKey(result.Metric)
+		if matched[key] {
+			return nil, fmt.Errorf("multiple series match {%s} in query %s", strings.TrimSuffix(key, ","), a.Query)
+		}
+
+		other, ok := right[key]
+		if !ok {
+			unmatched = append(unmatched, fmt.Sprintf("{%s} of query %s", strings.TrimSuffix(key, ","), a.Query))
+			continue
+		}
+		matched[key] = true
+
+		y, _ := latestValue(other.Values)
+		v, err := op.apply(x, y)
+		if err != nil {
+			return nil, err
+		}
+
+		metric := make(map[string]interface{}, len(result.Metric))
+		for k, lv := range result.Metric {
+			if matches(k) {
+				metric[k] = lv
+			}
+		}
+
+		combined.Results = append(combined.Results, &QueryResult{
+			Metric: metric,
+			Values: []*util.Vector{{Timestamp: latestVector(result.Values).Timestamp, Value: v}},
+		})
+	}
+
+	unmatchedRight := []string{}
+	for key := range right {
+		if !matched[key] {
+			unmatchedRight = append(unmatchedRight, fmt.Sprintf("{%s} of query %s", strings.TrimSuffix(key, ","), b.Query))
+		}
+	}
+	sort.Strings(unmatchedRight)
+	unmatched = append(unmatched, unmatchedRight...)
+
+	if len(unmatched) > 0 {
+		n := len(unmatched)
+		if n > maxUnmatchedReported {
+			unmatched = unmatched[:maxUnmatchedReported]
+		}
+		return nil, fmt.Errorf("%d series without a match for %s: %s", n, op, strings.Join(unmatched, ", "))
+	}
+
+	return combined, nil
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+
+	return false
+}
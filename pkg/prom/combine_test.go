@@ -0,0 +1,60 @@
+package prom_test
+
+import (
+	"testing"
+
+	"github.com/kubecost/cost-model/pkg/prom"
+	"github.com/kubecost/cost-model/pkg/util"
+)
+
+func newResults(query string, values map[string]float64, metric func(string) map[string]interface{}) *prom.QueryResults {
+	qr := &prom.QueryResults{Query: query}
+	for key, v := range values {
+		qr.Results = append(qr.Results, &prom.QueryResult{
+			Metric: metric(key),
+			Values: []*util.Vector{{Timestamp: 1600000000, Value: v}},
+		})
+	}
+	return qr
+}
+
+func TestCombineUnknownOp(t *testing.T) {
+	empty := &prom.QueryResults{Query: "x"}
+
+	_, err := prom.Combine(empty, empty, prom.ArithOp("%"), nil)
+	if err == nil {
+		t.Errorf("expected error for unknown operation")
+	}
+}
+
+func TestCombineIgnoring(t *testing.T) {
+	a := newResults("a", map[string]float64{"p": 2, "q": 3}, func(pod string) map[string]interface{} {
+		return map[string]interface{}{"__name__": "a", "pod": pod, "job": "x"}
+	})
+	b := newResults("b", map[string]float64{"p": 5, "q": 7}, func(pod string) map[string]interface{} {
+		return map[string]interface{}{"__name__": "b", "pod": pod, "job": "y"}
+	})
+
+	if _, err := prom.Combine(a, b, prom.ArithMul, nil); err == nil {
+		t.Errorf("expected error matching on all labels")
+	}
+
+	combined, err := prom.CombineIgnoring(a, b, prom.ArithMul, []string{"job"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := map[string]float64{"p": 10, "q": 21}
+	if combined.Len() != len(expected) {
+		t.Fatalf("expected %d series; got %d", len(expected), combined.Len())
+	}
+	for _, result := range combined.Results {
+		if _, ok := result.Metric["job"]; ok {
+			t.Errorf("expected ignored label to be dropped; got %v", result.Metric)
+		}
+		pod, _ := result.Metric["pod"].(string)
+		if v := result.Values[0].Value; v != expected[pod] {
+			t.Errorf("expected %f for pod %s; got %f", expected[pod], pod, v)
+		}
+	}
+}
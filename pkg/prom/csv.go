@@ -0,0 +1,111 @@
+package prom
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// QueryRangeToCSV runs the given range query and writes the resulting matrix
+// to w as CSV, one row per sample, without building the parsed results in
+// memory. Series may have differing label sets, so the header is the sorted
+// union of all label names across the result, followed by "timestamp" and
+// "value"; a series without a given label leaves its column empty. Timestamps
+// and values are written exactly as returned by Prometheus.
+//
+// Producing a union header requires two passes over the response: one to
+// collect label names and one to write rows. Errors from Prometheus are
+// detected on the first pass, so nothing is written to w if the query fails.
+func (ctx *Context) QueryRangeToCSV(w io.Writer, query string, start, end time.Time, step time.Duration) error {
+	err := ValidateRange(start, end, step)
+	if err != nil {
+		return fmt.Errorf("Error %s for query %s", err.Error(), query)
+	}
+
+	qp, err := ctx.queryParams(rangeParams(start, end, step), nil)
+	if err != nil {
+		return fmt.Errorf("Error %s for query %s", err.Error(), query)
+	}
+
+	body, err := ctx.request(context.Background(), epQueryRange, query, qp)
+	if err != nil {
+		return err
+	}
+
+	labelSet := map[string]bool{}
+	err = decodeMatrix(body, func(raw json.RawMessage) error {
+		var series struct {
+			Metric map[string]string `json:"metric"`
+		}
+		err := json.Unmarshal(raw, &series)
+		if err != nil {
+			return err
+		}
+
+		for label := range series.Metric {
+			labelSet[label] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error %w fetching query %s", err, query)
+	}
+
+	labels := make([]string, 0, len(labelSet))
+	for label := range labelSet {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	cw := csv.NewWriter(w)
+
+	err = cw.Write(append(append([]string{}, labels...), "timestamp", "value"))
+	if err != nil {
+		return err
+	}
+
+	row := make([]string, len(labels)+2)
+	err = decodeMatrix(body, func(raw json.RawMessage) error {
+		var series matrixSeries
+		err := json.Unmarshal(raw, &series)
+		if err != nil {
+			return err
+		}
+
+		for i, label := range labels {
+			row[i] = series.Metric[label]
+		}
+
+		for _, sample := range series.Values {
+			ts, ok := sample[0].(float64)
+			if !ok {
+				return fmt.Errorf("Improperly formatted datapoint from Prometheus")
+			}
+			value, ok := sample[1].(string)
+			if !ok {
+				return fmt.Errorf("Improperly formatted datapoint from Prometheus")
+			}
+
+			row[len(labels)] = strconv.FormatFloat(ts, 'f', -1, 64)
+			row[len(labels)+1] = value
+
+			err = cw.Write(row)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error %s writing query %s", err.Error(), query)
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
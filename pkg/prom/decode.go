@@ -0,0 +1,223 @@
+package prom
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"k8s.io/klog"
+)
+
+// matrixSeries is a single series of a range query response
+type matrixSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values [][2]interface{}  `json:"values"`
+}
+
+// decodeMatrix walks the body of a range query response, calling fn with the
+// raw JSON of each series as it is decoded, so that callers never need to hold
+// more than one series in memory. If Prometheus reported an error, or the
+// result is not a matrix, an error is returned.
+func decodeMatrix(body []byte, fn func(json.RawMessage) error) error {
+	return decodeResult(body, func(resultType string, raw json.RawMessage) error {
+		if resultType != "matrix" {
+			return fmt.Errorf("Result type '%s' is not a matrix", resultType)
+		}
+		return fn(raw)
+	})
+}
+
+// decodeResult walks the body of a query response, calling fn with the result
+// type and the raw JSON of each series of a vector or matrix result as it is
+// decoded, or of the whole result of a scalar or string result. If Prometheus
+// reported an error, an *APIError is returned.
+func decodeResult(body []byte, fn func(resultType string, raw json.RawMessage) error) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+
+	err := expectDelim(dec, '{')
+	if err != nil {
+		return err
+	}
+
+	var status, errorType, errorMsg string
+	for dec.More() {
+		key, err := decodeKey(dec)
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "status":
+			err = dec.Decode(&status)
+		case "errorType":
+			err = dec.Decode(&errorType)
+		case "error":
+			err = dec.Decode(&errorMsg)
+		case "data":
+			err = decodeResultData(dec, fn)
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if status == "error" {
+		return &APIError{ErrorType: errorType, Message: errorMsg}
+	}
+	if status != "success" {
+		return fmt.Errorf("Unexpected response status '%s' from Prometheus", status)
+	}
+
+	return nil
+}
+
+// decodeResultData walks the data field of a query response, calling fn with
+// the raw JSON of each series in the result. Prometheus writes the result type
+// before the result, which it determines the shape of.
+func decodeResultData(dec *json.Decoder, fn func(resultType string, raw json.RawMessage) error) error {
+	err := expectDelim(dec, '{')
+	if err != nil {
+		return err
+	}
+
+	var resultType string
+	for dec.More() {
+		key, err := decodeKey(dec)
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "resultType":
+			err = dec.Decode(&resultType)
+		case "result":
+			if resultType != "vector" && resultType != "matrix" {
+				var raw json.RawMessage
+				err = dec.Decode(&raw)
+				if err == nil {
+					err = fn(resultType, raw)
+				}
+				break
+			}
+
+			err = expectDelim(dec, '[')
+			for err == nil && dec.More() {
+				var raw json.RawMessage
+				err = dec.Decode(&raw)
+				if err == nil {
+					err = fn(resultType, raw)
+				}
+			}
+			if err == nil {
+				err = expectDelim(dec, ']')
+			}
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return expectDelim(dec, '}')
+}
+
+// decodeKey reads the next object key from the decoder
+func decodeKey(dec *json.Decoder) (string, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+
+	key, ok := t.(string)
+	if !ok {
+		return "", fmt.Errorf("Expected object key in Prometheus response, found %v", t)
+	}
+
+	return key, nil
+}
+
+// expectDelim reads the next token from the decoder, returning an error if it
+// is not the given delimiter
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if d, ok := t.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("Expected '%s' in Prometheus response, found %v", delim, t)
+	}
+
+	return nil
+}
+
+// decodeLimited decodes the body of a query response as json.Unmarshal would,
+// but one series at a time, stopping as soon as the result exceeds the
+// Context's MaxSeries. Unless TruncateSeries is set, the result is then
+// abandoned with a *SeriesLimitError. Otherwise, the remaining series are
+// skipped without being decoded, and a warning describing the truncation is
+// returned with the result.
+func (ctx *Context) decodeLimited(query string, body []byte) (interface{}, string, error) {
+	var resultType string
+	var result interface{}
+	series := []interface{}{}
+	count := 0
+
+	err := decodeResult(body, func(rt string, raw json.RawMessage) error {
+		resultType = rt
+		if rt != "vector" && rt != "matrix" {
+			return json.Unmarshal(raw, &result)
+		}
+
+		count++
+		if count > ctx.MaxSeries {
+			if !ctx.TruncateSeries {
+				return &SeriesLimitError{Query: query, Limit: ctx.MaxSeries}
+			}
+			return nil
+		}
+
+		var s interface{}
+		err := json.Unmarshal(raw, &s)
+		if err != nil {
+			return err
+		}
+		series = append(series, s)
+		return nil
+	})
+	if err != nil {
+		var ae *APIError
+		var sle *SeriesLimitError
+		if errors.As(err, &sle) {
+			return nil, "", err
+		}
+		if errors.As(err, &ae) {
+			return nil, "", fmt.Errorf("Error %w fetching query %s", ae, query)
+		}
+		return nil, "", fmt.Errorf("Error %s fetching query %s", err.Error(), query)
+	}
+
+	var warning string
+	if count > ctx.MaxSeries {
+		warning = fmt.Sprintf("result truncated from %d series to the maximum of %d", count, ctx.MaxSeries)
+		klog.V(1).Infof("[Warning] Truncated %d series to %d for query %s", count, ctx.MaxSeries, ctx.loggable(query))
+	}
+
+	if resultType == "vector" || resultType == "matrix" {
+		result = series
+	}
+
+	return map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"resultType": resultType,
+			"result":     result,
+		},
+	}, warning, nil
+}
@@ -0,0 +1,46 @@
+package prom_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kubecost/cost-model/pkg/prom"
+	"github.com/kubecost/cost-model/pkg/prom/promtest"
+)
+
+const threeSeries = `{"status":"success","data":{"resultType":"vector","result":[
+	{"metric":{"pod":"a"},"value":[1600000000,"1"]},
+	{"metric":{"pod":"b"},"value":[1600000000,"2"]},
+	{"metric":{"pod":"c"},"value":[1600000000,"3"]}
+]}}`
+
+func TestMaxSeriesTruncateWarns(t *testing.T) {
+	ctx, c := promtest.NewContext()
+	ctx.MaxSeries = 2
+	ctx.TruncateSeries = true
+	c.RespondJSON("up", threeSeries)
+
+	qr := ctx.Query("up").AwaitResults()
+	if qr.Error != nil {
+		t.Fatalf("unexpected error: %s", qr.Error)
+	}
+	if qr.Len() != 2 {
+		t.Errorf("expected 2 series; got %d", qr.Len())
+	}
+	if len(qr.Warnings) != 1 {
+		t.Errorf("expected a truncation warning; got %v", qr.Warnings)
+	}
+}
+
+func TestMaxSeriesLimitError(t *testing.T) {
+	ctx, c := promtest.NewContext()
+	ctx.MaxSeries = 2
+	c.RespondJSON("up", threeSeries)
+
+	qr := ctx.Query("up").AwaitResults()
+
+	var sle *prom.SeriesLimitError
+	if !errors.As(qr.Error, &sle) {
+		t.Errorf("expected SeriesLimitError; got %v", qr.Error)
+	}
+}
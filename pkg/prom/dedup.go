@@ -0,0 +1,99 @@
+package prom
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kubecost/cost-model/pkg/util"
+)
+
+// DedupStrategy determines which value survives when duplicate series are
+// collapsed by Dedup
+type DedupStrategy int
+
+const (
+	// DedupMax keeps the largest value at each timestamp
+	DedupMax DedupStrategy = iota
+	// DedupFirst keeps the value from the first series with each timestamp
+	DedupFirst
+	// DedupLast keeps the value from the last series with each timestamp
+	DedupLast
+)
+
+// Dedup collapses series with identical label sets into a single series, as
+// can occur in federated or pre-deduplication Thanos responses. Where
+// duplicates share a timestamp, the strategy chooses the surviving value;
+// samples at timestamps unique to one duplicate are kept. Series retain the
+// order of their first occurrence.
+//
+// Callers should typically rely on server-side deduplication (e.g. the Thanos
+// dedup parameter), using Dedup as a safety net against double counting.
+func (qr *QueryResults) Dedup(strategy DedupStrategy) {
+	if qr == nil || len(qr.Results) < 2 {
+		return
+	}
+
+	deduped := []*QueryResult{}
+	byKey := map[string]*QueryResult{}
+
+	for _, result := range qr.Results {
+		key := labelsKey(result.Metric)
+
+		existing, ok := byKey[key]
+		if !ok {
+			byKey[key] = result
+			deduped = append(deduped, result)
+			continue
+		}
+
+		existing.Values = dedupValues(existing.Values, result.Values, strategy)
+	}
+
+	qr.Results = deduped
+}
+
+// dedupValues merges the values of a duplicate series, ys, into those of the
+// series of first occurrence, xs, according to the strategy
+func dedupValues(xs, ys []*util.Vector, strategy DedupStrategy) []*util.Vector {
+	byTimestamp := make(map[float64]*util.Vector, len(xs))
+	for _, x := range xs {
+		byTimestamp[x.Timestamp] = x
+	}
+
+	for _, y := range ys {
+		x, ok := byTimestamp[y.Timestamp]
+		if !ok {
+			xs = append(xs, y)
+			byTimestamp[y.Timestamp] = y
+			continue
+		}
+
+		switch strategy {
+		case DedupMax:
+			if y.Value > x.Value {
+				x.Value = y.Value
+			}
+		case DedupLast:
+			x.Value = y.Value
+		}
+	}
+
+	sort.Sort(util.VectorSlice(xs))
+	return xs
+}
+
+// labelsKey returns a string which uniquely identifies the label set
+func labelsKey(metric map[string]interface{}) string {
+	keys := make([]string, 0, len(metric))
+	for k := range metric {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&sb, "%s=%q,", k, fmt.Sprintf("%v", metric[k]))
+	}
+	return sb.String()
+}
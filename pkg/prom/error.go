@@ -0,0 +1,225 @@
+package prom
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxSnippetLength is the maximum number of bytes of a response body retained
+// on an UpstreamError
+const maxSnippetLength = 256
+
+// RetryableError is implemented by errors which describe a failure that may
+// succeed if the query is attempted again.
+type RetryableError interface {
+	error
+	Retryable() bool
+}
+
+// IsRetryable returns true if the error, or any error it wraps, is a
+// RetryableError which reports itself as retryable.
+func IsRetryable(err error) bool {
+	var re RetryableError
+	if errors.As(err, &re) {
+		return re.Retryable()
+	}
+
+	return false
+}
+
+// UpstreamError is returned when the response to a query is not JSON, which
+// typically indicates that a proxy or load balancer in front of Prometheus
+// responded in its place; e.g. with an HTML 502 page.
+type UpstreamError struct {
+	Endpoint    string
+	Query       string
+	StatusCode  int
+	ContentType string
+	Snippet     string
+}
+
+// NewUpstreamError creates a new UpstreamError from the response and body,
+// retaining a truncated snippet of the body.
+func NewUpstreamError(endpoint string, query string, resp *http.Response, body []byte) *UpstreamError {
+	snippet := body
+	if len(snippet) > maxSnippetLength {
+		snippet = snippet[:maxSnippetLength]
+	}
+
+	ue := &UpstreamError{
+		Endpoint: endpoint,
+		Query:    query,
+		Snippet:  strings.TrimSpace(string(snippet)),
+	}
+	if resp != nil {
+		ue.StatusCode = resp.StatusCode
+		ue.ContentType = resp.Header.Get("Content-Type")
+	}
+
+	return ue
+}
+
+// Error returns a message describing the status and body of the response
+func (ue *UpstreamError) Error() string {
+	subject := ue.Endpoint
+	if ue.Query != "" {
+		subject = "query " + ue.Query
+	}
+
+	return fmt.Sprintf("%d Error non-JSON response (Content-Type: '%s') fetching %s: %s", ue.StatusCode, ue.ContentType, subject, ue.Snippet)
+}
+
+// Retryable returns true if the status indicates a transient failure; i.e. a
+// 5xx, such as a gateway failing to reach Prometheus, or 429. Other statuses,
+// such as a 405 for a request made with a method the endpoint does not accept,
+// will fail the same way if retried.
+func (ue *UpstreamError) Retryable() bool {
+	return ue.StatusCode >= 500 || ue.StatusCode == http.StatusTooManyRequests
+}
+
+// isNonJSONResponse returns true if the response declares a Content-Type other
+// than JSON, or if the body looks like markup.
+func isNonJSONResponse(resp *http.Response, body []byte) bool {
+	if resp != nil {
+		ct := resp.Header.Get("Content-Type")
+		if ct != "" && !strings.Contains(ct, "json") {
+			return true
+		}
+	}
+
+	return bytes.HasPrefix(bytes.TrimSpace(body), []byte("<"))
+}
+
+// NotPrometheusError is returned when an endpoint responds successfully, but
+// the response does not have the shape of a Prometheus API response, which
+// typically indicates that the configured address points at another service.
+type NotPrometheusError struct {
+	URL    string
+	Reason string
+}
+
+// Error returns a message describing why the endpoint was rejected
+func (npe *NotPrometheusError) Error() string {
+	return fmt.Sprintf("endpoint does not look like a Prometheus API (%s): %s", npe.URL, npe.Reason)
+}
+
+// CanceledError is the error of a query whose context was canceled, or whose
+// deadline passed, before it completed
+type CanceledError struct {
+	Query string
+	Err   error
+}
+
+// Error returns a message naming the query and the reason it was canceled
+func (ce *CanceledError) Error() string {
+	return fmt.Sprintf("Canceled (%s) fetching query %s", ce.Err, ce.Query)
+}
+
+// Unwrap returns the context error which caused the cancellation
+func (ce *CanceledError) Unwrap() error {
+	return ce.Err
+}
+
+// QueryError is the error of a query which could not be fetched, indicating a
+// problem reaching the backend, or with the backend or the query itself
+type QueryError struct {
+	Query string
+	Err   error
+}
+
+// Error returns the message of the underlying error, which names the query
+func (qe *QueryError) Error() string {
+	return qe.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (qe *QueryError) Unwrap() error {
+	return qe.Err
+}
+
+// ParseError is the error of a query whose response was fetched, but could not
+// be parsed, indicating an incompatibility between this package and the
+// backend's response format
+type ParseError struct {
+	Query string
+	Err   error
+}
+
+// Error returns a message naming the query and the parse failure
+func (pe *ParseError) Error() string {
+	return fmt.Sprintf("%s parsing response to query %s", pe.Err, pe.Query)
+}
+
+// Unwrap returns the underlying error
+func (pe *ParseError) Unwrap() error {
+	return pe.Err
+}
+
+// APIError is the error reported by Prometheus in a response with status
+// "error"; e.g. a PromQL syntax error (bad_data) or a failure evaluating the
+// query (execution).
+type APIError struct {
+	ErrorType string
+	Message   string
+}
+
+// Error returns the message reported by Prometheus, and its type
+func (ae *APIError) Error() string {
+	if ae.ErrorType == "" {
+		return ae.Message
+	}
+
+	return fmt.Sprintf("%s (%s)", ae.Message, ae.ErrorType)
+}
+
+// TimeoutPhase identifies the phase of a request which timed out
+type TimeoutPhase string
+
+const (
+	// TimeoutDial is the phase connecting to the backend
+	TimeoutDial TimeoutPhase = "dial"
+	// TimeoutTLSHandshake is the phase negotiating TLS with the backend
+	TimeoutTLSHandshake TimeoutPhase = "TLS handshake"
+	// TimeoutResponseHeader is the phase waiting for the backend to respond,
+	// once the request has been written
+	TimeoutResponseHeader TimeoutPhase = "response header"
+	// TimeoutOverall is the whole request, including reading the response
+	TimeoutOverall TimeoutPhase = "overall"
+)
+
+// TimeoutError is the error of a request which exceeded one of the phase
+// timeouts configured on a RoundTripper by NewRoundTripper; e.g. by
+// WithDialTimeout. A dial timeout
+// generally indicates the backend is unreachable, whereas a response header
+// timeout indicates it is reachable, but busy.
+type TimeoutError struct {
+	Phase   TimeoutPhase
+	Timeout time.Duration
+	Err     error
+}
+
+// Error returns a message naming the phase which timed out
+func (te *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timeout (%s) exceeded: %s", te.Phase, te.Timeout, te.Err)
+}
+
+// Unwrap returns the underlying timeout error
+func (te *TimeoutError) Unwrap() error {
+	return te.Err
+}
+
+// SeriesLimitError is the error of a query whose result contains more series
+// than the MaxSeries of its Context
+type SeriesLimitError struct {
+	Query string
+	Limit int
+}
+
+// Error returns a message naming the query and the limit it exceeded
+func (sle *SeriesLimitError) Error() string {
+	return fmt.Sprintf("Result exceeds maximum of %d series for query %s", sle.Limit, sle.Query)
+}
@@ -0,0 +1,123 @@
+package prom
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// WriteExposition writes the latest value of each series of the results to w
+// in the Prometheus text exposition format, as a gauge with the given metric
+// name, so that results can be re-exposed to another scraper. The series'
+// labels are written in sorted order, except for __name__, which is replaced
+// by the metric name. Samples are written without timestamps, so scrapers
+// assign their own. Series without values are skipped. An error is returned if
+// the metric name or a label name is invalid, or if two series would share a
+// label set once __name__ is replaced.
+func (qr *QueryResults) WriteExposition(w io.Writer, metricName string) error {
+	if !isValidMetricName(metricName) {
+		return fmt.Errorf("invalid metric name '%s'", metricName)
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# TYPE %s gauge\n", metricName)
+
+	seen := map[string]bool{}
+	for _, result := range qr.Results {
+		value, ok := latestValue(result.Values)
+		if !ok {
+			continue
+		}
+
+		keys := make([]string, 0, len(result.Metric))
+		for k := range result.Metric {
+			if k == metricNameLabel {
+				continue
+			}
+			if !isValidLabelName(k) {
+				return fmt.Errorf("invalid label name '%s' for metric %s", k, metricName)
+			}
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var sb strings.Builder
+		for i, k := range keys {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			fmt.Fprintf(&sb, `%s="%s"`, k, escapeLabelValue(fmt.Sprintf("%v", result.Metric[k])))
+		}
+		labels := sb.String()
+
+		if seen[labels] {
+			return fmt.Errorf("duplicate series {%s} for metric %s", labels, metricName)
+		}
+		seen[labels] = true
+
+		if labels != "" {
+			fmt.Fprintf(bw, "%s{%s} %s\n", metricName, labels, formatSampleValue(value))
+		} else {
+			fmt.Fprintf(bw, "%s %s\n", metricName, formatSampleValue(value))
+		}
+	}
+
+	return bw.Flush()
+}
+
+// escapeLabelValue escapes backslashes, double quotes and line feeds, as
+// required of label values in the text exposition format
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// formatSampleValue formats a sample value as expected by the text exposition
+// format, which spells out infinities and NaN
+func formatSampleValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// isValidMetricName returns true if the name matches [a-zA-Z_:][a-zA-Z0-9_:]*
+func isValidMetricName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(isAlpha(c) || c == '_' || c == ':' || (i > 0 && isDigit(c))) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isValidLabelName returns true if the name matches [a-zA-Z_][a-zA-Z0-9_]*
+func isValidLabelName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(isAlpha(c) || c == '_' || (i > 0 && isDigit(c))) {
+			return false
+		}
+	}
+
+	return true
+}
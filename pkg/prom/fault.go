@@ -0,0 +1,132 @@
+package prom
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	prometheus "github.com/prometheus/client_golang/api"
+	"k8s.io/klog"
+)
+
+// faultInjectionEnvVar must be set to "true" for WithFaultInjection to take
+// effect, so that faults cannot be enabled in production by configuration alone
+const faultInjectionEnvVar = "PROM_FAULT_INJECTION_ENABLED"
+
+// FaultInjection describes synthetic faults injected into the requests of a
+// Context, for testing how callers handle failing or slow backends. Faults are
+// injected beneath the Context, so retries, timeouts and adaptive concurrency
+// observe them as they would real faults. See WithFaultInjection.
+type FaultInjection struct {
+	// Latency is added to every request, unless its context is done first
+	Latency time.Duration
+	// ErrorRate is the probability, in [0, 1], of a request failing with a
+	// retryable *FaultError in place of a response
+	ErrorRate float64
+	// StatusCode, if set, is the status of the non-JSON response served in
+	// place of the real response with probability StatusRate; e.g. 503,
+	// simulating a proxy in front of an unavailable Prometheus
+	StatusCode int
+	StatusRate float64
+	// Seed seeds the source of randomness, so that the sequence of injected
+	// faults is deterministic for a given sequence of requests
+	Seed int64
+}
+
+// FaultError is the error of a request failed by fault injection
+type FaultError struct {
+	URL string
+}
+
+// Error returns a message naming the request which was failed
+func (fe *FaultError) Error() string {
+	return fmt.Sprintf("injected fault requesting %s", fe.URL)
+}
+
+// Retryable returns true, as injected errors simulate transient failures
+func (fe *FaultError) Retryable() bool {
+	return true
+}
+
+// WithFaultInjection configures the Context to inject the given faults into
+// its requests. It is intended for resilience testing only, and has no effect
+// unless the PROM_FAULT_INJECTION_ENABLED environment variable is "true".
+func WithFaultInjection(fi FaultInjection) ContextOption {
+	return func(ctx *Context) {
+		if !strings.EqualFold(os.Getenv(faultInjectionEnvVar), "true") {
+			klog.Infof("[Warning] Ignoring fault injection: %s is not set to true", faultInjectionEnvVar)
+			return
+		}
+
+		klog.Infof("[Warning] Injecting faults into Prometheus requests: %+v", fi)
+		ctx.faults = &fi
+	}
+}
+
+// faultClient is a prometheus.Client which injects faults into the requests
+// made with a wrapped client
+type faultClient struct {
+	prometheus.Client
+	faults FaultInjection
+	m      sync.Mutex
+	rand   *rand.Rand
+}
+
+func newFaultClient(client prometheus.Client, fi *FaultInjection) *faultClient {
+	return &faultClient{
+		Client: client,
+		faults: *fi,
+		rand:   rand.New(rand.NewSource(fi.Seed)),
+	}
+}
+
+// URL builds the URL with the wrapped client
+func (fc *faultClient) URL(ep string, args map[string]string) *url.URL {
+	return fc.Client.URL(ep, args)
+}
+
+// Do delays the request, then fails it or serves the configured status, as
+// chosen at random, or otherwise makes the request with the wrapped client
+func (fc *faultClient) Do(ctx context.Context, req *http.Request) (*http.Response, []byte, prometheus.Warnings, error) {
+	// Faults are chosen before the delay, so that the sequence of faults does
+	// not depend on the timing of concurrent requests
+	fc.m.Lock()
+	fail := fc.rand.Float64() < fc.faults.ErrorRate
+	status := fc.faults.StatusCode != 0 && fc.rand.Float64() < fc.faults.StatusRate
+	fc.m.Unlock()
+
+	if fc.faults.Latency > 0 {
+		t := time.NewTimer(fc.faults.Latency)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, nil, nil, ctx.Err()
+		}
+	}
+
+	if fail {
+		return nil, nil, nil, &FaultError{URL: req.URL.String()}
+	}
+
+	if status {
+		body := fmt.Sprintf("injected fault: %d %s", fc.faults.StatusCode, http.StatusText(fc.faults.StatusCode))
+		resp := &http.Response{
+			Status:     fmt.Sprintf("%d %s", fc.faults.StatusCode, http.StatusText(fc.faults.StatusCode)),
+			StatusCode: fc.faults.StatusCode,
+			Header:     http.Header{"Content-Type": []string{"text/plain"}},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}
+		return resp, []byte(body), nil, nil
+	}
+
+	return fc.Client.Do(ctx, req)
+}
@@ -0,0 +1,34 @@
+package prom
+
+import (
+	"context"
+	"net/url"
+)
+
+const (
+	epFormatQuery = apiPrefix + "/format_query"
+)
+
+// FormatQuery returns the query as pretty-printed by Prometheus, for making
+// logged or displayed queries legible. The query is sent as given; label
+// matchers configured with WithLabelMatcher are not injected. Requires a
+// Prometheus which supports the format_query endpoint (v2.38+). An error is
+// returned if the query cannot be parsed.
+func (ctx *Context) FormatQuery(query string) (string, error) {
+	// The query is passed as a parameter, rather than as the subject of the
+	// request, so that it is formatted exactly as given
+	params := url.Values{"query": []string{query}}
+
+	body, err := ctx.request(context.Background(), epFormatQuery, "", params)
+	if err != nil {
+		return "", err
+	}
+
+	var formatted string
+	err = decodeAPIResponse(epFormatQuery, body, &formatted)
+	if err != nil {
+		return "", err
+	}
+
+	return formatted, nil
+}
@@ -0,0 +1,60 @@
+package prom
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// gzipMagic are the first bytes of every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decodeContentEncoding returns the body of the response, decompressing it if
+// it is declared to be gzip encoded. Some proxies declare gzip encoding for
+// bodies which are not compressed, so the body is only decompressed if it
+// starts with the gzip magic bytes, and is otherwise used as is if it is valid
+// JSON. An error is returned if it is neither.
+//
+// It is applied by the RoundTripper of NewRoundTripper, which requests
+// compression itself so that the Go transport leaves bodies encoded, and again
+// to the response of every request, for clients which do the same. When left
+// to the Go transport, a body falsely declared to be gzip encoded fails with a
+// gzip error before it can be decoded, so clients behind such proxies must be
+// created with a RoundTripper from NewRoundTripper.
+func decodeContentEncoding(resp *http.Response, body []byte) ([]byte, error) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return body, nil
+	}
+
+	// The body is returned decoded, so the header no longer applies
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+
+	if bytes.HasPrefix(body, gzipMagic) {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err == nil {
+			var decoded []byte
+			decoded, err = ioutil.ReadAll(zr)
+			if err == nil {
+				return decoded, nil
+			}
+		}
+
+		return nil, fmt.Errorf("Error %s decompressing gzip encoded response", err.Error())
+	}
+
+	if json.Valid(body) {
+		klog.V(3).Infof("Response declared gzip encoding, but is not compressed; using it as is")
+		return body, nil
+	}
+
+	return nil, fmt.Errorf("Response declared gzip encoding, but is neither gzip nor JSON")
+}
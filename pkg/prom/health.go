@@ -0,0 +1,159 @@
+package prom
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultHealthWindow is the period over which HealthStats are computed, when
+// the Context does not set HealthWindow
+const DefaultHealthWindow = 5 * time.Minute
+
+// healthBuckets is the number of intervals the health window is divided into.
+// Requests expire from the window one interval at a time.
+const healthBuckets = 60
+
+// HealthStats summarizes the outcomes of the requests a Context completed
+// within the recent window, for reporting the health of its connection to
+// Prometheus. Requests are counted once, however many times they were retried,
+// and canceled requests are not counted. Rates are zero when no requests have
+// completed.
+type HealthStats struct {
+	Window    time.Duration
+	Requests  int
+	Succeeded int
+	Failed    int
+	// Retried is the number of requests retried at least once, and Retries
+	// the total number of retries
+	Retried int
+	Retries int
+	// Timeouts is the number of requests which failed by timing out
+	Timeouts int
+
+	SuccessRate float64
+	RetryRate   float64
+	TimeoutRate float64
+}
+
+// HealthStats returns statistics on the requests completed within the last
+// HealthWindow
+func (ctx *Context) HealthStats() HealthStats {
+	return ctx.health.stats(ctx.healthWindow(), time.Now())
+}
+
+// healthWindow returns the configured health window, or the default
+func (ctx *Context) healthWindow() time.Duration {
+	if ctx.HealthWindow <= 0 {
+		return DefaultHealthWindow
+	}
+	return ctx.HealthWindow
+}
+
+// recordHealth records the outcome of a request which was retried the given
+// number of times
+func (ctx *Context) recordHealth(retries int, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	ctx.health.record(ctx.healthWindow(), time.Now(), retries, err)
+}
+
+// healthBucket counts the outcomes of requests completed within one interval
+type healthBucket struct {
+	slot      int64
+	requests  int
+	succeeded int
+	retried   int
+	retries   int
+	timeouts  int
+}
+
+// healthCounter counts the outcomes of requests in a ring of buckets, each
+// covering an interval of the window
+type healthCounter struct {
+	m       sync.Mutex
+	width   time.Duration
+	buckets [healthBuckets]healthBucket
+}
+
+// slot returns the index of the interval containing the time, resetting the
+// buckets if the window has changed
+func (hc *healthCounter) slot(window time.Duration, now time.Time) int64 {
+	width := window / healthBuckets
+	if width <= 0 {
+		width = 1
+	}
+	if width != hc.width {
+		hc.width = width
+		hc.buckets = [healthBuckets]healthBucket{}
+	}
+
+	return now.UnixNano() / int64(width)
+}
+
+func (hc *healthCounter) record(window time.Duration, now time.Time, retries int, err error) {
+	hc.m.Lock()
+	defer hc.m.Unlock()
+
+	slot := hc.slot(window, now)
+	b := &hc.buckets[slot%healthBuckets]
+	if b.slot != slot {
+		*b = healthBucket{slot: slot}
+	}
+
+	b.requests++
+	if err == nil {
+		b.succeeded++
+	} else if isTimeout(err) {
+		b.timeouts++
+	}
+	if retries > 0 {
+		b.retried++
+		b.retries += retries
+	}
+}
+
+func (hc *healthCounter) stats(window time.Duration, now time.Time) HealthStats {
+	hc.m.Lock()
+	defer hc.m.Unlock()
+
+	hs := HealthStats{Window: window}
+
+	slot := hc.slot(window, now)
+	for _, b := range hc.buckets {
+		if b.slot <= slot-healthBuckets || b.slot > slot {
+			continue
+		}
+
+		hs.Requests += b.requests
+		hs.Succeeded += b.succeeded
+		hs.Retried += b.retried
+		hs.Retries += b.retries
+		hs.Timeouts += b.timeouts
+	}
+
+	hs.Failed = hs.Requests - hs.Succeeded
+	if hs.Requests > 0 {
+		n := float64(hs.Requests)
+		hs.SuccessRate = float64(hs.Succeeded) / n
+		hs.RetryRate = float64(hs.Retried) / n
+		hs.TimeoutRate = float64(hs.Timeouts) / n
+	}
+
+	return hs
+}
+
+// isTimeout returns true if the error is due to a request timing out
+func isTimeout(err error) bool {
+	var te *TimeoutError
+	if errors.As(err, &te) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
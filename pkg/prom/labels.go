@@ -0,0 +1,81 @@
+package prom
+
+import "fmt"
+
+// metricNameLabel is the internal label holding the metric name of a series
+const metricNameLabel = "__name__"
+
+// LabelCardinality returns, for each label key across all series of the
+// results, the number of series carrying each of its values. The internal
+// __name__ label is excluded; see LabelCardinalityWithName.
+func (qr *QueryResults) LabelCardinality() map[string]map[string]int {
+	return qr.labelCardinality(false)
+}
+
+// LabelCardinalityWithName is LabelCardinality, including the __name__ label
+func (qr *QueryResults) LabelCardinalityWithName() map[string]map[string]int {
+	return qr.labelCardinality(true)
+}
+
+func (qr *QueryResults) labelCardinality(includeName bool) map[string]map[string]int {
+	cardinality := map[string]map[string]int{}
+	if qr == nil {
+		return cardinality
+	}
+
+	for _, result := range qr.Results {
+		for k, v := range result.Metric {
+			if k == metricNameLabel && !includeName {
+				continue
+			}
+
+			value, ok := v.(string)
+			if !ok {
+				value = fmt.Sprintf("%v", v)
+			}
+
+			counts, ok := cardinality[k]
+			if !ok {
+				counts = map[string]int{}
+				cardinality[k] = counts
+			}
+			counts[value]++
+		}
+	}
+
+	return cardinality
+}
+
+// GroupByFunc groups the series of the results by the key returned by the
+// given function for the labels of each series, including __name__, so that
+// series can be grouped by keys which are not themselves labels; e.g. an
+// environment derived from the namespace. Series retain their order within
+// each group. The labels passed to the function may be retained or modified.
+func (qr *QueryResults) GroupByFunc(fn func(labels map[string]string) string) map[string][]*QueryResult {
+	groups := map[string][]*QueryResult{}
+	if qr == nil {
+		return groups
+	}
+
+	for _, result := range qr.Results {
+		key := fn(stringLabels(result.Metric))
+		groups[key] = append(groups[key], result)
+	}
+
+	return groups
+}
+
+// stringLabels returns a copy of the metric's labels with their values as
+// strings
+func stringLabels(metric map[string]interface{}) map[string]string {
+	labels := make(map[string]string, len(metric))
+	for k, v := range metric {
+		value, ok := v.(string)
+		if !ok {
+			value = fmt.Sprintf("%v", v)
+		}
+		labels[k] = value
+	}
+
+	return labels
+}
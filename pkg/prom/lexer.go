@@ -0,0 +1,221 @@
+package prom
+
+import (
+	"fmt"
+	"strings"
+)
+
+// tokenKind classifies the tokens of a PromQL expression
+type tokenKind int
+
+const (
+	tokIdentifier tokenKind = iota
+	tokNumber
+	tokString
+	tokOperator
+	tokLeftParen
+	tokRightParen
+	tokLeftBrace
+	tokRightBrace
+	tokLeftBracket
+	tokRightBracket
+	tokComma
+	tokColon
+	tokAt
+	tokComment
+)
+
+// token is a single lexical token of a PromQL expression, and its byte offset
+// within the expression
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// promqlKeywords are the identifiers which PromQL reserves as operators and
+// modifiers, rather than metric names. They are matched case-insensitively.
+var promqlKeywords = map[string]bool{
+	"and":         true,
+	"or":          true,
+	"unless":      true,
+	"atan2":       true,
+	"by":          true,
+	"without":     true,
+	"on":          true,
+	"ignoring":    true,
+	"group_left":  true,
+	"group_right": true,
+	"offset":      true,
+	"bool":        true,
+	"inf":         true,
+	"nan":         true,
+}
+
+// promqlGroupings are the keywords followed by a parenthesized list of label
+// names
+var promqlGroupings = map[string]bool{
+	"by":          true,
+	"without":     true,
+	"on":          true,
+	"ignoring":    true,
+	"group_left":  true,
+	"group_right": true,
+}
+
+// promqlAggregations are the aggregation operators, which may be followed by
+// a grouping before their parenthesized arguments; e.g. sum by (x) (y)
+var promqlAggregations = map[string]bool{
+	"sum":          true,
+	"min":          true,
+	"max":          true,
+	"avg":          true,
+	"group":        true,
+	"stddev":       true,
+	"stdvar":       true,
+	"count":        true,
+	"count_values": true,
+	"bottomk":      true,
+	"topk":         true,
+	"quantile":     true,
+}
+
+// lexPromQL splits a PromQL expression into tokens. It recognizes enough of
+// the language to locate selectors and normalize formatting, but does not
+// validate the expression; that is left to Prometheus.
+func lexPromQL(query string) ([]token, error) {
+	tokens := []token{}
+	bracketDepth := 0
+
+	for i := 0; i < len(query); {
+		c := query[i]
+		start := i
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '#':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			tokens = append(tokens, token{tokComment, query[start:i], start})
+			continue
+		case c == '"' || c == '\'' || c == '`':
+			i++
+			for i < len(query) && query[i] != c {
+				if query[i] == '\\' && c != '`' {
+					i++
+				}
+				i++
+			}
+			if i >= len(query) {
+				return nil, fmt.Errorf("unterminated string at position %d of query", start)
+			}
+			i++
+			tokens = append(tokens, token{tokString, query[start:i], start})
+			continue
+		case isDigit(c) || (c == '.' && i+1 < len(query) && isDigit(query[i+1])):
+			for i < len(query) && (isAlphanumeric(query[i]) || query[i] == '.') {
+				// Allow signed exponents; e.g. 1e-3
+				if (query[i] == 'e' || query[i] == 'E') && i+1 < len(query) && (query[i+1] == '+' || query[i+1] == '-') && !strings.HasPrefix(query[start:], "0x") {
+					i++
+				}
+				i++
+			}
+			tokens = append(tokens, token{tokNumber, query[start:i], start})
+			continue
+		case isAlpha(c) || c == '_' || (c == ':' && bracketDepth == 0):
+			for i < len(query) && (isAlphanumeric(query[i]) || query[i] == '_' || (query[i] == ':' && bracketDepth == 0)) {
+				i++
+			}
+			tokens = append(tokens, token{tokIdentifier, query[start:i], start})
+			continue
+		}
+
+		kind := tokOperator
+		width := 1
+		switch c {
+		case '(':
+			kind = tokLeftParen
+		case ')':
+			kind = tokRightParen
+		case '{':
+			kind = tokLeftBrace
+		case '}':
+			kind = tokRightBrace
+		case '[':
+			kind = tokLeftBracket
+			bracketDepth++
+		case ']':
+			kind = tokRightBracket
+			bracketDepth--
+		case ',':
+			kind = tokComma
+		case ':':
+			kind = tokColon
+		case '@':
+			kind = tokAt
+		case '=', '!', '<', '>':
+			if i+1 < len(query) && (query[i+1] == '=' || query[i+1] == '~') {
+				width = 2
+			}
+		case '+', '-', '*', '/', '%', '^':
+		default:
+			return nil, fmt.Errorf("unexpected character '%c' at position %d of query", c, i)
+		}
+
+		i += width
+		tokens = append(tokens, token{kind, query[start:i], start})
+	}
+
+	return tokens, nil
+}
+
+// nextToken returns the index of the first non-comment token after i, or -1
+func nextToken(tokens []token, i int) int {
+	for j := i + 1; j < len(tokens); j++ {
+		if tokens[j].kind != tokComment {
+			return j
+		}
+	}
+	return -1
+}
+
+// matchingToken returns the index of the token closing the group opened at i,
+// or -1 if the group is unterminated
+func matchingToken(tokens []token, i int) int {
+	open, close := tokens[i].kind, tokRightParen
+	switch open {
+	case tokLeftBrace:
+		close = tokRightBrace
+	case tokLeftBracket:
+		close = tokRightBracket
+	}
+
+	depth := 0
+	for j := i; j < len(tokens); j++ {
+		switch tokens[j].kind {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isAlphanumeric(c byte) bool {
+	return isAlpha(c) || isDigit(c) || c == '_'
+}
@@ -0,0 +1,127 @@
+package prom
+
+import (
+	"fmt"
+	"time"
+)
+
+// localDateFormat is the format of the date of a LocalDay
+const localDateFormat = "2006-01-02"
+
+// LocalDay is a calendar day in a time zone, spanning [Start, End) from one
+// local midnight to the next. Because of daylight saving transitions, a local
+// day is not always 24 hours long.
+type LocalDay struct {
+	Date  string
+	Start time.Time
+	End   time.Time
+}
+
+// Duration returns the length of the day; e.g. 23 hours on the day clocks
+// spring forward
+func (ld LocalDay) Duration() time.Duration {
+	return ld.End.Sub(ld.Start)
+}
+
+// Contains returns true if the time falls within [Start, End)
+func (ld LocalDay) Contains(t time.Time) bool {
+	return !t.Before(ld.Start) && t.Before(ld.End)
+}
+
+// LocalDays returns the calendar days in the given location which overlap
+// [start, end), in order, from the local midnight at or before start to the
+// local midnight at or after end.
+func LocalDays(loc *time.Location, start, end time.Time) []LocalDay {
+	days := []LocalDay{}
+
+	s := start.In(loc)
+	day := localMidnight(s.Year(), s.Month(), s.Day(), loc)
+
+	for day.Before(end) {
+		// Find the midnight of the next date, rather than adding 24 hours, so
+		// that days are 23 or 25 hours long across daylight saving transitions
+		next := localMidnight(day.Year(), day.Month(), day.Day()+1, loc)
+
+		days = append(days, LocalDay{
+			Date:  day.Format(localDateFormat),
+			Start: day,
+			End:   next,
+		})
+		day = next
+	}
+
+	return days
+}
+
+// localMidnight returns the first instant of the given date in the location.
+// In the rare zones which change clocks at midnight, that date may have no
+// midnight, in which case the day starts at the first instant after the gap.
+func localMidnight(year int, month time.Month, day int, loc *time.Location) time.Time {
+	t := time.Date(year, month, day, 0, 0, 0, 0, loc)
+
+	// time.Date resolves a skipped midnight to a time on the previous day,
+	// so move forward until the date is correct
+	for t.Day() != time.Date(year, month, day, 12, 0, 0, 0, loc).Day() {
+		t = t.Add(time.Hour - time.Duration(t.Minute())*time.Minute)
+	}
+
+	return t
+}
+
+// DailyRange returns the start and end of a range query covering the given
+// days, aligned to their local midnights, validating that the step evenly
+// divides each day so that every local midnight falls on an evaluation step.
+// Steps that divide an hour divide every day in almost all time zones. The
+// samples of the query can then be bucketed with QueryResults.ByLocalDay.
+func DailyRange(days []LocalDay, step time.Duration) (time.Time, time.Time, error) {
+	if len(days) == 0 {
+		return time.Time{}, time.Time{}, fmt.Errorf("no days to query")
+	}
+	if step <= 0 {
+		return time.Time{}, time.Time{}, fmt.Errorf("step must be positive (step: %s)", step)
+	}
+
+	for _, day := range days {
+		if day.Duration()%step != 0 {
+			return time.Time{}, time.Time{}, fmt.Errorf("step %s does not evenly divide local day %s of %s", step, day.Date, day.Duration())
+		}
+	}
+
+	return days[0].Start, days[len(days)-1].End, nil
+}
+
+// ByLocalDay splits the results of a range query into one QueryResults per
+// day, keyed by the day's date, each containing the samples of every series
+// whose timestamps fall within [Start, End) of that day. Series without
+// samples on a day are omitted from it, and samples outside all days are
+// dropped. Note that a sample at a local midnight belongs to the day it
+// starts; for queries whose samples summarize the preceding step, such as
+// increase(x[1h]), offset the query by the step so each sample is assigned to
+// the day it summarizes.
+func (qr *QueryResults) ByLocalDay(days []LocalDay) map[string]*QueryResults {
+	byDay := make(map[string]*QueryResults, len(days))
+	for _, day := range days {
+		byDay[day.Date] = qr.withResults([]*QueryResult{})
+	}
+
+	for _, result := range qr.Results {
+		for _, day := range days {
+			values := RangeResult{}
+			for _, v := range result.Values {
+				if day.Contains(vectorTime(v)) {
+					values = append(values, v)
+				}
+			}
+			if len(values) == 0 {
+				continue
+			}
+
+			byDay[day.Date].Results = append(byDay[day.Date].Results, &QueryResult{
+				Metric: result.Metric,
+				Values: values,
+			})
+		}
+	}
+
+	return byDay
+}
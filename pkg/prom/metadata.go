@@ -0,0 +1,339 @@
+package prom
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	epSeries = apiPrefix + "/series"
+)
+
+// DefaultSeriesChunkSize is the maximum number of selectors sent in a single
+// series request, when the Context does not set SeriesChunkSize
+const DefaultSeriesChunkSize = 100
+
+// LabelValues returns the values of the given label across all series. Results
+// are cached according to the Context's MetadataCacheTTL, in which case the
+// returned slice is shared and must not be modified.
+//
+// If the Context injects label matchers, the values are instead collected from
+// the series carrying both the label and the injected matchers, as returned by
+// the series endpoint, which always applies its selectors. The label values
+// endpoint is not used, as servers which do not support match[] for it ignore
+// the parameter, and would return the values of every series.
+func (ctx *Context) LabelValues(label string) ([]string, error) {
+	ep := apiPrefix + "/label/" + url.PathEscape(label) + "/values"
+
+	if len(ctx.matchers) > 0 {
+		return ctx.restrictedLabelValues(ep, label)
+	}
+
+	v, err := ctx.metadata.lookup(ctx.MetadataCacheTTL, ep, nil, func() (interface{}, error) {
+		// The label values endpoint does not accept a POST
+		body, err := ctx.requestMethod(context.Background(), http.MethodGet, ep, "", nil)
+		if err != nil {
+			return nil, err
+		}
+
+		values := []string{}
+		err = decodeAPIResponse(ep, body, &values)
+		if err != nil {
+			return nil, err
+		}
+		return values, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.([]string), nil
+}
+
+// restrictedLabelValues returns the sorted, distinct values of the label on
+// the series selected by the injected matchers, cached under the label values
+// endpoint ep
+func (ctx *Context) restrictedLabelValues(ep string, label string) ([]string, error) {
+	if !isValidLabelName(label) {
+		return nil, fmt.Errorf("invalid label name '%s'", label)
+	}
+
+	selector, err := InjectMatchers(fmt.Sprintf(`{%s!=""}`, label), ctx.matchers)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{"match[]": []string{selector}}
+
+	v, err := ctx.metadata.lookup(ctx.MetadataCacheTTL, ep, params, func() (interface{}, error) {
+		body, err := ctx.request(context.Background(), epSeries, "", params)
+		if err != nil {
+			return nil, err
+		}
+
+		series := []map[string]string{}
+		err = decodeAPIResponse(epSeries, body, &series)
+		if err != nil {
+			return nil, err
+		}
+
+		seen := map[string]bool{}
+		values := []string{}
+		for _, labels := range series {
+			value, ok := labels[label]
+			if !ok || value == "" || seen[value] {
+				continue
+			}
+			seen[value] = true
+			values = append(values, value)
+		}
+		sort.Strings(values)
+
+		return values, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.([]string), nil
+}
+
+// Series returns the label sets of all series matching any of the given
+// selectors over the range [start, end]. Results are cached according to the
+// Context's MetadataCacheTTL, in which case they are shared and must not be
+// modified.
+//
+// Selectors are split into chunks of at most SeriesChunkSize, each fetched
+// with a separate, concurrent request. Label sets are returned in the order of
+// the chunk, then of the response, they were first seen in, with duplicates
+// matched by more than one chunk removed. If any chunk fails, its error is
+// returned.
+func (ctx *Context) Series(matchers []string, start, end time.Time) ([]map[string]string, error) {
+	if len(ctx.matchers) > 0 {
+		injected := make([]string, len(matchers))
+		for i, m := range matchers {
+			s, err := InjectMatchers(m, ctx.matchers)
+			if err != nil {
+				return nil, fmt.Errorf("Error %s injecting label matchers into selector %s", err.Error(), m)
+			}
+			injected[i] = s
+		}
+		matchers = injected
+	}
+
+	size := ctx.SeriesChunkSize
+	if size <= 0 {
+		size = DefaultSeriesChunkSize
+	}
+	if len(matchers) <= size {
+		return ctx.series(matchers, start, end)
+	}
+
+	chunks := [][]string{}
+	for i := 0; i < len(matchers); i += size {
+		j := i + size
+		if j > len(matchers) {
+			j = len(matchers)
+		}
+		chunks = append(chunks, matchers[i:j])
+	}
+
+	results := make([][]map[string]string, len(chunks))
+	errs := make([]error, len(chunks))
+
+	var wg sync.WaitGroup
+	wg.Add(len(chunks))
+	for i, chunk := range chunks {
+		go func(i int, chunk []string) {
+			defer wg.Done()
+			results[i], errs[i] = ctx.series(chunk, start, end)
+		}(i, chunk)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	seen := map[string]bool{}
+	merged := []map[string]string{}
+	for _, series := range results {
+		for _, labels := range series {
+			key := stringLabelsKey(labels)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			merged = append(merged, labels)
+		}
+	}
+
+	return merged, nil
+}
+
+// series fetches the label sets of the series matching any of the selectors in
+// a single request
+func (ctx *Context) series(matchers []string, start, end time.Time) ([]map[string]string, error) {
+	params := url.Values{
+		"match[]": matchers,
+		"start":   []string{formatTime(start)},
+		"end":     []string{formatTime(end)},
+	}
+
+	v, err := ctx.metadata.lookup(ctx.MetadataCacheTTL, epSeries, params, func() (interface{}, error) {
+		body, err := ctx.request(context.Background(), epSeries, "", params)
+		if err != nil {
+			return nil, err
+		}
+
+		series := []map[string]string{}
+		err = decodeAPIResponse(epSeries, body, &series)
+		if err != nil {
+			return nil, err
+		}
+		return series, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.([]map[string]string), nil
+}
+
+// stringLabelsKey returns a key identifying the label set
+func stringLabelsKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&sb, "%s=%q,", k, labels[k])
+	}
+	return sb.String()
+}
+
+// ClearMetadataCache discards all cached metadata lookups, so that the next
+// lookup of each is fetched from Prometheus
+func (ctx *Context) ClearMetadataCache() {
+	ctx.metadata.clear()
+}
+
+// metadataCache memoizes metadata lookups for a short window, and coalesces
+// identical lookups made concurrently into a single request. Cached values
+// are shared between callers and must not be modified.
+type metadataCache struct {
+	m        sync.Mutex
+	entries  map[string]*metadataEntry
+	inflight map[string]*metadataCall
+}
+
+type metadataEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+type metadataCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// lookup returns the value cached for the endpoint and parameters, if any is
+// yet to expire. Otherwise, it waits for an identical lookup in progress, or
+// calls fetch, caching a successful result for the given ttl. A ttl of zero or
+// less disables caching and coalescing entirely.
+func (mc *metadataCache) lookup(ttl time.Duration, ep string, params url.Values, fetch func() (interface{}, error)) (interface{}, error) {
+	if ttl <= 0 {
+		return fetch()
+	}
+
+	key := metadataKey(ep, params)
+
+	mc.m.Lock()
+	if e, ok := mc.entries[key]; ok && time.Now().Before(e.expires) {
+		mc.m.Unlock()
+		return e.value, nil
+	}
+	if call, ok := mc.inflight[key]; ok {
+		mc.m.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+
+	call := &metadataCall{done: make(chan struct{})}
+	if mc.inflight == nil {
+		mc.inflight = map[string]*metadataCall{}
+	}
+	mc.inflight[key] = call
+	mc.m.Unlock()
+
+	call.value, call.err = fetch()
+
+	mc.m.Lock()
+	delete(mc.inflight, key)
+	if call.err == nil {
+		if mc.entries == nil {
+			mc.entries = map[string]*metadataEntry{}
+		}
+		now := time.Now()
+		mc.prune(now)
+		mc.entries[key] = &metadataEntry{
+			value:   call.value,
+			expires: now.Add(ttl),
+		}
+	}
+	mc.m.Unlock()
+
+	close(call.done)
+
+	return call.value, call.err
+}
+
+// metadataKey returns the cache key of a lookup, normalizing any selectors in
+// its parameters so that cosmetically different lookups share a key
+func metadataKey(ep string, params url.Values) string {
+	normalized := make(url.Values, len(params))
+	for k, vs := range params {
+		if k != "match[]" {
+			normalized[k] = vs
+			continue
+		}
+
+		selectors := make([]string, len(vs))
+		for i, v := range vs {
+			selectors[i] = NormalizeQuery(v)
+		}
+		normalized[k] = selectors
+	}
+
+	return ep + "?" + normalized.Encode()
+}
+
+// prune removes the entries which have expired by the given time, so that
+// the cache holds no more than the lookups made within the last ttl. The
+// caller must hold the lock.
+func (mc *metadataCache) prune(now time.Time) {
+	for key, e := range mc.entries {
+		if !now.Before(e.expires) {
+			delete(mc.entries, key)
+		}
+	}
+}
+
+// clear discards all cached entries. Lookups in progress are unaffected.
+func (mc *metadataCache) clear() {
+	mc.m.Lock()
+	defer mc.m.Unlock()
+
+	mc.entries = nil
+}
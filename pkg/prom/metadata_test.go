@@ -0,0 +1,45 @@
+package prom_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kubecost/cost-model/pkg/prom"
+	"github.com/kubecost/cost-model/pkg/prom/promtest"
+)
+
+func TestLabelValuesWithLabelMatcher(t *testing.T) {
+	c := promtest.NewClient()
+	ctx := prom.NewContext(c, prom.WithLabelMatcher("tenant", "a"))
+
+	c.RespondJSON("/api/v1/series", `{"status":"success","data":[
+		{"__name__":"up","pod":"z","tenant":"a"},
+		{"__name__":"up","pod":"b","tenant":"a"},
+		{"__name__":"x","pod":"z","tenant":"a"}
+	]}`)
+
+	values, err := ctx.LabelValues("pod")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := []string{"b", "z"}; !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %v; got %v", expected, values)
+	}
+
+	reqs := c.Requests()
+	if len(reqs) != 1 || reqs[0].Endpoint != "/api/v1/series" {
+		t.Fatalf("expected a single series request; got %+v", reqs)
+	}
+	if expected := `{tenant="a",pod!=""}`; reqs[0].Params.Get("match[]") != expected {
+		t.Errorf("expected selector %s; got %s", expected, reqs[0].Params.Get("match[]"))
+	}
+}
+
+func TestLabelValuesRejectsInvalidLabelWithLabelMatcher(t *testing.T) {
+	ctx := prom.NewContext(promtest.NewClient(), prom.WithLabelMatcher("tenant", "a"))
+
+	_, err := ctx.LabelValues(`pod!="",x`)
+	if err == nil {
+		t.Errorf("expected error for invalid label name")
+	}
+}
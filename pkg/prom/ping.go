@@ -0,0 +1,83 @@
+package prom
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// pingQuery is a trivial query which any Prometheus API can evaluate cheaply
+const pingQuery = "vector(1)"
+
+// pingResult caches the outcome of Ping once it has been determined whether
+// or not the endpoint is a Prometheus API
+type pingResult struct {
+	m    sync.Mutex
+	done bool
+	err  error
+}
+
+// Ping verifies that the Context's client is talking to a Prometheus API by
+// running a trivial query and inspecting the shape of the response. If the
+// endpoint responds, but not as Prometheus would, a NotPrometheusError is
+// returned. The outcome is cached once determined, so Ping may be called
+// before every use of the Context without cost; errors reaching the endpoint
+// are not cached, as they say nothing about what the endpoint is.
+func (ctx *Context) Ping() error {
+	ctx.ping.m.Lock()
+	defer ctx.ping.m.Unlock()
+
+	if ctx.ping.done {
+		return ctx.ping.err
+	}
+
+	conclusive, err := ctx.checkPrometheus()
+	if conclusive {
+		ctx.ping.done = true
+		ctx.ping.err = err
+	}
+
+	return err
+}
+
+// checkPrometheus probes the query endpoint, returning whether or not the
+// result is conclusive, i.e. the endpoint responded successfully, and a
+// non-nil error if it does not appear to be a Prometheus API.
+func (ctx *Context) checkPrometheus() (bool, error) {
+	u := ctx.Client.URL(epQuery, nil).String()
+
+	body, err := ctx.request(context.Background(), epQuery, pingQuery, nil)
+	if err != nil {
+		// A non-JSON response to a successful request is as good as a
+		// signature; e.g. a login page. Anything else may be transient.
+		var ue *UpstreamError
+		if errors.As(err, &ue) && ue.StatusCode >= 200 && ue.StatusCode < 300 {
+			return true, &NotPrometheusError{URL: u, Reason: fmt.Sprintf("response has Content-Type '%s'", ue.ContentType)}
+		}
+		return false, err
+	}
+
+	var resp apiResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return true, &NotPrometheusError{URL: u, Reason: "response is not a JSON object"}
+	}
+
+	switch resp.Status {
+	case "success":
+		var data struct {
+			ResultType string `json:"resultType"`
+		}
+		if json.Unmarshal(resp.Data, &data) != nil || data.ResultType == "" {
+			return true, &NotPrometheusError{URL: u, Reason: "response has no resultType"}
+		}
+		return true, nil
+	case "error":
+		// Prometheus errors still identify a Prometheus API
+		return true, nil
+	default:
+		return true, &NotPrometheusError{URL: u, Reason: fmt.Sprintf("response has unexpected status '%s'", resp.Status)}
+	}
+}
@@ -0,0 +1,308 @@
+package prom
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kubecost/cost-model/pkg/util"
+)
+
+// Subquery returns the subquery evaluating the inner expression over the
+// given window at the given resolution; e.g. (rate(x[5m]))[1h:30s]. The window
+// and resolution must be positive, the resolution must not exceed the window,
+// and the window must be a whole multiple of the resolution so that every
+// evaluation step falls within it. Both durations must be whole milliseconds,
+// the smallest unit of a PromQL duration.
+func Subquery(inner string, window, resolution time.Duration) (string, error) {
+	if window <= 0 {
+		return "", fmt.Errorf("subquery range must be positive (range: %s)", window)
+	}
+	if resolution <= 0 {
+		return "", fmt.Errorf("subquery resolution must be positive (resolution: %s)", resolution)
+	}
+	if window%time.Millisecond != 0 || resolution%time.Millisecond != 0 {
+		return "", fmt.Errorf("subquery range and resolution must be whole milliseconds (range: %s, resolution: %s)", window, resolution)
+	}
+	if resolution > window {
+		return "", fmt.Errorf("subquery resolution must not exceed range (range: %s, resolution: %s)", window, resolution)
+	}
+	if window%resolution != 0 {
+		return "", fmt.Errorf("subquery range must be a multiple of resolution (range: %s, resolution: %s)", window, resolution)
+	}
+
+	return fmt.Sprintf("(%s)[%s:%s]", inner, util.FormatDuration(window), util.FormatDuration(resolution)), nil
+}
+
+// LabelMatcher is an equality matcher of a label to a value; e.g. tenant="a"
+type LabelMatcher struct {
+	Label string
+	Value string
+}
+
+// String returns the matcher in PromQL syntax
+func (lm LabelMatcher) String() string {
+	return fmt.Sprintf("%s=%s", lm.Label, strconv.Quote(lm.Value))
+}
+
+// WithLabelMatcher configures the Context to inject an equality matcher of the
+// label to the value into every selector of every query it runs, and into the
+// matchers of metadata lookups, so that callers cannot select series outside
+// of it; e.g. to enforce a tenant boundary. See InjectMatchers for how queries
+// are rewritten, and the limitations of doing so. The option may be given more
+// than once to inject multiple matchers.
+//
+// Requests which select no series are not restricted: FormatQuery sends its
+// query as given, and Flags returns the server's configuration. TSDBStats,
+// which would describe every series, fails instead.
+func WithLabelMatcher(label, value string) ContextOption {
+	return func(ctx *Context) {
+		ctx.matchers = append(ctx.matchers, LabelMatcher{Label: label, Value: value})
+	}
+}
+
+// validate returns an error if the label is not a valid label name, which
+// would otherwise allow arbitrary PromQL to be injected through it
+func (lm LabelMatcher) validate() error {
+	if lm.Label == "" {
+		return fmt.Errorf("label matcher has an empty label name")
+	}
+
+	if !isValidLabelName(lm.Label) {
+		return fmt.Errorf("label matcher has an invalid label name '%s'", lm.Label)
+	}
+
+	return nil
+}
+
+// InjectMatchers returns the query with the given matchers added to every
+// vector selector it contains, so that only series matching all of them can
+// be selected; e.g. injecting tenant="a" into
+//
+//	sum(rate(http_requests_total{code="500"}[5m])) / sum(up)
+//
+// returns
+//
+//	sum(rate(http_requests_total{tenant="a",code="500"}[5m])) / sum(up{tenant="a"})
+//
+// Because matchers within a selector must all match, an existing matcher on
+// the same label cannot widen the selection. The query's formatting is
+// otherwise preserved.
+//
+// The rewrite is lexical: selectors are located by tokenizing the query, not
+// by fully parsing it, so identifiers are classified by context (e.g. an
+// identifier followed by "(" is a function). Expressions which select no
+// series, such as vector(1), are unchanged, and functions which manipulate
+// labels after selection, such as label_replace, may still produce output
+// series which do not carry the injected labels, though their inputs were
+// restricted. Malformed queries which cannot be tokenized return an error.
+func InjectMatchers(query string, matchers []LabelMatcher) (string, error) {
+	if len(matchers) == 0 {
+		return query, nil
+	}
+
+	strs := make([]string, len(matchers))
+	for i, m := range matchers {
+		err := m.validate()
+		if err != nil {
+			return "", err
+		}
+		strs[i] = m.String()
+	}
+	injected := strings.Join(strs, ",")
+
+	tokens, err := lexPromQL(query)
+	if err != nil {
+		return "", err
+	}
+
+	type insertion struct {
+		pos  int
+		text string
+	}
+	insertions := []insertion{}
+
+	// injectBraces adds the matchers inside the selector braces opened at i,
+	// returning the index of the closing brace
+	injectBraces := func(i int) (int, error) {
+		end := matchingToken(tokens, i)
+		if end < 0 {
+			return 0, fmt.Errorf("unterminated selector at position %d of query", tokens[i].pos)
+		}
+
+		text := injected
+		if end != nextToken(tokens, i) {
+			text += ","
+		}
+		insertions = append(insertions, insertion{tokens[i].pos + 1, text})
+
+		return end, nil
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+
+		switch t.kind {
+		case tokLeftBrace:
+			i, err = injectBraces(i)
+			if err != nil {
+				return "", err
+			}
+		case tokIdentifier:
+			next := nextToken(tokens, i)
+			lower := strings.ToLower(t.text)
+
+			if promqlKeywords[lower] {
+				// Skip the label names of a grouping; e.g. by (x, y)
+				if promqlGroupings[lower] && next >= 0 && tokens[next].kind == tokLeftParen {
+					end := matchingToken(tokens, next)
+					if end < 0 {
+						return "", fmt.Errorf("unterminated grouping at position %d of query", tokens[next].pos)
+					}
+					i = end
+				}
+				continue
+			}
+
+			// Function calls and aggregations are not selectors
+			if next >= 0 && tokens[next].kind == tokLeftParen {
+				continue
+			}
+			if next >= 0 && promqlAggregations[lower] && tokens[next].kind == tokIdentifier && promqlGroupings[strings.ToLower(tokens[next].text)] {
+				continue
+			}
+
+			if next >= 0 && tokens[next].kind == tokLeftBrace {
+				i, err = injectBraces(next)
+				if err != nil {
+					return "", err
+				}
+				continue
+			}
+
+			insertions = append(insertions, insertion{t.pos + len(t.text), "{" + injected + "}"})
+		}
+	}
+
+	var sb strings.Builder
+	last := 0
+	for _, ins := range insertions {
+		sb.WriteString(query[last:ins.pos])
+		sb.WriteString(ins.text)
+		last = ins.pos
+	}
+	sb.WriteString(query[last:])
+
+	return sb.String(), nil
+}
+
+// NormalizeQuery returns a canonical form of the query, so that queries which
+// differ only cosmetically share a key in caches, request coalescing and logs.
+// Comments are removed, keywords and aggregation operators are lowercased, and
+// whitespace is rewritten to a single consistent style; e.g.
+//
+//	SUM BY(namespace)( rate(x{a = "b"} [5m]) )
+//
+// becomes
+//
+//	sum by (namespace) (rate(x{a="b"}[5m]))
+//
+// Queries which cannot be tokenized are only stripped of redundant whitespace.
+// Normalization is lexical, so equivalent but differently structured queries,
+// such as those with redundant parentheses, are not unified.
+func NormalizeQuery(query string) string {
+	tokens, err := lexPromQL(query)
+	if err != nil {
+		return strings.Join(strings.Fields(query), " ")
+	}
+
+	var sb strings.Builder
+	var prev *token
+	prevUnary := false
+	braceDepth := 0
+	groupingDepth := 0
+	parenDepth := 0
+	groupingParens := []int{}
+
+	for i := range tokens {
+		tok := tokens[i]
+		if tok.kind == tokComment {
+			continue
+		}
+
+		text := tok.text
+		lower := strings.ToLower(text)
+		if tok.kind == tokIdentifier && braceDepth == 0 && groupingDepth == 0 && (promqlKeywords[lower] || promqlAggregations[lower]) {
+			text = lower
+		}
+
+		if prev != nil && spaceBetween(*prev, prevUnary, tok, braceDepth) {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(text)
+
+		unary := false
+		switch tok.kind {
+		case tokLeftBrace:
+			braceDepth++
+		case tokRightBrace:
+			braceDepth--
+		case tokLeftParen:
+			parenDepth++
+			if prev != nil && prev.kind == tokIdentifier && promqlGroupings[strings.ToLower(prev.text)] {
+				groupingDepth++
+				groupingParens = append(groupingParens, parenDepth)
+			}
+		case tokRightParen:
+			if n := len(groupingParens); n > 0 && groupingParens[n-1] == parenDepth {
+				groupingDepth--
+				groupingParens = groupingParens[:n-1]
+			}
+			parenDepth--
+		case tokOperator:
+			// A sign is unary when it cannot be preceded by an operand
+			if tok.text == "+" || tok.text == "-" {
+				unary = prev == nil || prevUnary || (prev.kind == tokIdentifier && promqlKeywords[strings.ToLower(prev.text)]) ||
+					prev.kind == tokOperator || prev.kind == tokLeftParen || prev.kind == tokLeftBracket || prev.kind == tokComma || prev.kind == tokAt
+			}
+		}
+
+		prev = &tokens[i]
+		prevUnary = unary
+	}
+
+	return sb.String()
+}
+
+// spaceBetween returns true if the normalized form of a query separates the
+// token cur from the token prev preceding it by a space
+func spaceBetween(prev token, prevUnary bool, cur token, braceDepth int) bool {
+	switch cur.kind {
+	case tokRightParen, tokRightBracket, tokRightBrace, tokComma, tokColon:
+		return false
+	}
+
+	switch prev.kind {
+	case tokLeftParen, tokLeftBracket, tokLeftBrace, tokColon:
+		return false
+	case tokComma:
+		return braceDepth == 0
+	}
+
+	// Matchers are written without spaces; e.g. {a="b",c!~"d"}
+	if braceDepth > 0 {
+		return false
+	}
+
+	switch cur.kind {
+	case tokLeftParen:
+		// Function calls and aggregations are followed directly by their
+		// arguments, but groupings and parenthesized expressions are not
+		return !(prev.kind == tokIdentifier && !promqlKeywords[strings.ToLower(prev.text)])
+	case tokLeftBracket, tokLeftBrace:
+		return prev.kind != tokIdentifier && prev.kind != tokRightParen && prev.kind != tokRightBrace
+	}
+
+	return !prevUnary
+}
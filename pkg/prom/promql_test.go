@@ -0,0 +1,69 @@
+package prom_test
+
+import (
+	"testing"
+
+	"github.com/kubecost/cost-model/pkg/prom"
+)
+
+func TestInjectMatchers(t *testing.T) {
+	tenant := []prom.LabelMatcher{{Label: "tenant", Value: "a"}}
+
+	cases := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{"bare metric", `up`, `up{tenant="a"}`},
+		{"existing matchers", `up{job="x"}`, `up{tenant="a",job="x"}`},
+		{"name matcher only", `{__name__="up"}`, `{tenant="a",__name__="up"}`},
+		{"recording rule", `namespace:container_cpu_usage:sum_rate`, `namespace:container_cpu_usage:sum_rate{tenant="a"}`},
+		{"by before arguments", `sum by (namespace) (rate(x[5m]))`, `sum by (namespace) (rate(x{tenant="a"}[5m]))`},
+		{"without after arguments", `sum(x) without (pod, node)`, `sum(x{tenant="a"}) without (pod, node)`},
+		{"on group_left", `a * on (pod) group_left (node) b`, `a{tenant="a"} * on (pod) group_left (node) b{tenant="a"}`},
+		{"ignoring group_right", `a / ignoring(code) group_right b`, `a{tenant="a"} / ignoring(code) group_right b{tenant="a"}`},
+		{"bool modifier", `count(x) > bool 2`, `count(x{tenant="a"}) > bool 2`},
+		{"set operator", `topk(3, x) or y`, `topk(3, x{tenant="a"}) or y{tenant="a"}`},
+		{"subquery", `max_over_time(rate(x[5m])[1h:1m])`, `max_over_time(rate(x{tenant="a"}[5m])[1h:1m])`},
+		{"offset", `x offset 5m`, `x{tenant="a"} offset 5m`},
+		{"at timestamp", `x @ 1609746000`, `x{tenant="a"} @ 1609746000`},
+		{"at function", `rate(x[5m] @ end())`, `rate(x{tenant="a"}[5m] @ end())`},
+		{"comment", "x # total {y}\n+ z", "x{tenant=\"a\"} # total {y}\n+ z{tenant=\"a\"}"},
+		{"string with braces", `label_replace(x, "dst", "{a}", "src", "(.*)")`, `label_replace(x{tenant="a"}, "dst", "{a}", "src", "(.*)")`},
+		{"no selectors", `vector(1)`, `vector(1)`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actual, err := prom.InjectMatchers(c.query, tenant)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if actual != c.expected {
+				t.Errorf("expected %s; got %s", c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestInjectMatchersErrors(t *testing.T) {
+	cases := []struct {
+		name     string
+		query    string
+		matchers []prom.LabelMatcher
+	}{
+		{"unterminated selector", `sum by (pod) (x{`, []prom.LabelMatcher{{Label: "tenant", Value: "a"}}},
+		{"unterminated string", `x{a="b}`, []prom.LabelMatcher{{Label: "tenant", Value: "a"}}},
+		{"invalid label name", `x`, []prom.LabelMatcher{{Label: "a}b", Value: "c"}}},
+		{"empty label name", `x`, []prom.LabelMatcher{{Label: "", Value: "c"}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := prom.InjectMatchers(c.query, c.matchers)
+			if err == nil {
+				t.Errorf("expected error injecting into %s", c.query)
+			}
+		})
+	}
+}
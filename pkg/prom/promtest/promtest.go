@@ -0,0 +1,230 @@
+// Package promtest provides an in-memory stand-in for a Prometheus server so
+// that code built on top of prom.Context can be tested without standing up an
+// HTTP server.
+package promtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/kubecost/cost-model/pkg/prom"
+	prometheus "github.com/prometheus/client_golang/api"
+)
+
+// EmptyVector is a successful instant query response containing no results
+const EmptyVector = `{"status":"success","data":{"resultType":"vector","result":[]}}`
+
+// Response is a canned response served by the Client. If Error is set, it is
+// returned from Do in place of a response, simulating a transport failure.
+// Warnings are returned from Do directly, as by a client which reads them
+// from outside the body; see RespondWarnings for warnings in the body.
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       string
+	Warnings   []string
+	Error      error
+}
+
+// Request records a single request made against the Client
+type Request struct {
+	Method   string
+	Endpoint string
+	Query    string
+	Params   url.Values
+}
+
+// Client is an in-memory prometheus.Client which serves canned responses keyed
+// by query string (or by endpoint, for requests which do not carry a query) and
+// records each request in the order it was received.
+type Client struct {
+	m         sync.Mutex
+	responses map[string]*Response
+	requests  []*Request
+}
+
+// NewClient creates a new Client with no canned responses
+func NewClient() *Client {
+	return &Client{
+		responses: map[string]*Response{},
+	}
+}
+
+// NewContext creates a prom.Context backed by a new Client, returning both so
+// that tests can configure responses and assert on the requests made.
+func NewContext() (*prom.Context, *Client) {
+	c := NewClient()
+	return prom.NewContext(c), c
+}
+
+// Respond registers the Response to serve for the given query. For requests
+// which do not carry a query, the key is matched against the endpoint instead;
+// e.g. "/api/v1/status/flags".
+func (c *Client) Respond(key string, resp *Response) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.responses[key] = resp
+}
+
+// RespondJSON registers a 200 response with the given JSON body for the given query
+func (c *Client) RespondJSON(key string, body string) {
+	c.Respond(key, &Response{
+		StatusCode: http.StatusOK,
+		Body:       body,
+	})
+}
+
+// RespondWarnings registers a 200 response with the given JSON body for the
+// given query, with the warnings added to the warnings field of the body, as
+// Prometheus returns them. The body must be a JSON object.
+func (c *Client) RespondWarnings(key string, body string, warnings ...string) {
+	var envelope map[string]interface{}
+	err := json.Unmarshal([]byte(body), &envelope)
+	if err != nil {
+		panic(fmt.Sprintf("promtest: body for '%s' is not a JSON object: %s", key, err))
+	}
+	envelope["warnings"] = warnings
+
+	b, err := json.Marshal(envelope)
+	if err != nil {
+		panic(fmt.Sprintf("promtest: encoding body for '%s': %s", key, err))
+	}
+
+	c.RespondJSON(key, string(b))
+}
+
+// RespondError registers a transport-level error for the given query
+func (c *Client) RespondError(key string, err error) {
+	c.Respond(key, &Response{
+		Error: err,
+	})
+}
+
+// RespondPromError registers a Prometheus API error response, as returned by
+// Prometheus on a bad or failed query, for the given query
+func (c *Client) RespondPromError(key string, statusCode int, errorType string, message string) {
+	c.Respond(key, &Response{
+		StatusCode: statusCode,
+		Body:       fmt.Sprintf(`{"status":"error","errorType":%q,"error":%q}`, errorType, message),
+	})
+}
+
+// Requests returns each request received by the Client, in order
+func (c *Client) Requests() []*Request {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	reqs := make([]*Request, len(c.requests))
+	copy(reqs, c.requests)
+	return reqs
+}
+
+// Queries returns the query string of each request received by the Client, in order
+func (c *Client) Queries() []string {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	queries := []string{}
+	for _, r := range c.requests {
+		if r.Query != "" {
+			queries = append(queries, r.Query)
+		}
+	}
+	return queries
+}
+
+// Reset clears all recorded requests, leaving registered responses in place
+func (c *Client) Reset() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.requests = nil
+}
+
+// URL implements prometheus.Client, building URLs against a placeholder host
+func (c *Client) URL(ep string, args map[string]string) *url.URL {
+	p := path.Join("/", ep)
+	for arg, val := range args {
+		p = strings.Replace(p, ":"+arg, val, -1)
+	}
+
+	return &url.URL{
+		Scheme: "http",
+		Host:   "promtest",
+		Path:   p,
+	}
+}
+
+// Do implements prometheus.Client, recording the request and serving the
+// Response registered for its query or endpoint
+func (c *Client) Do(ctx context.Context, req *http.Request) (*http.Response, []byte, prometheus.Warnings, error) {
+	if ctx != nil {
+		select {
+		case <-ctx.Done():
+			return nil, nil, nil, ctx.Err()
+		default:
+		}
+	}
+
+	params, err := prom.RequestParams(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	query := params.Get("query")
+
+	c.m.Lock()
+	c.requests = append(c.requests, &Request{
+		Method:   req.Method,
+		Endpoint: req.URL.Path,
+		Query:    query,
+		Params:   params,
+	})
+
+	key := query
+	if key == "" {
+		key = req.URL.Path
+	}
+	resp, ok := c.responses[key]
+	c.m.Unlock()
+
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("promtest: no response registered for '%s'", key)
+	}
+
+	if resp.Error != nil {
+		return nil, nil, prometheus.Warnings(resp.Warnings), resp.Error
+	}
+
+	header := http.Header{}
+	for k, vs := range resp.Header {
+		header[k] = vs
+	}
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "application/json")
+	}
+
+	statusCode := resp.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+
+	body := []byte(resp.Body)
+	httpResp := &http.Response{
+		Status:     fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode: statusCode,
+		Header:     header,
+		Body:       ioutil.NopCloser(strings.NewReader(resp.Body)),
+		Request:    req,
+	}
+
+	return httpResp, body, prometheus.Warnings(resp.Warnings), nil
+}
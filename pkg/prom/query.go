@@ -1,10 +1,18 @@
 package prom
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/kubecost/cost-model/pkg/util"
 	prometheus "github.com/prometheus/client_golang/api"
@@ -16,26 +24,115 @@ const (
 	epQuery   = apiPrefix + "/query"
 )
 
+const (
+	paramLookbackDelta = "lookback_delta"
+)
+
+// DefaultQueryLogLength is the default maximum number of characters of a query
+// which are included in log messages
+const DefaultQueryLogLength = 256
+
 // Context wraps a Prometheus client and provides methods for querying and
 // parsing query responses and errors.
 type Context struct {
 	Client         prometheus.Client
 	ErrorCollector *util.ErrorCollector
-	semaphore      *util.Semaphore
+	// QueryLogLength caps the number of characters of a query included in
+	// log messages. Zero or less disables truncation.
+	QueryLogLength int
+	// QueryLogHash replaces queries in log messages with a short hash, which
+	// can be used to correlate log lines without persisting the query itself.
+	QueryLogHash bool
+	// ExtraParams are added to the parameters of every query run by the
+	// Context; e.g. partial_response=true. See QueryWithParams for precedence.
+	ExtraParams url.Values
+	// LookbackDelta, if non-zero, overrides the server's lookback delta for
+	// every query; i.e. how far back Prometheus looks for the latest sample of
+	// a series. Must be positive. Requires a Prometheus which supports the
+	// lookback_delta parameter.
+	LookbackDelta time.Duration
+	// QueryAllBatchSize, if positive, limits the number of queries passed to
+	// a single call of QueryAll which are in flight at once. See QueryAll.
+	QueryAllBatchSize int
+	// MaxQueryLength, if positive, is the maximum length of a query the
+	// Context will send. Longer queries fail without making a request.
+	MaxQueryLength int
+	// MetadataCacheTTL, if positive, is how long the results of metadata
+	// lookups (LabelValues, Series) are cached and shared between callers.
+	// See ClearMetadataCache.
+	MetadataCacheTTL time.Duration
+	// SeriesChunkSize, if positive, is the maximum number of selectors sent
+	// in a single request by Series, which splits larger lookups across
+	// multiple requests. Defaults to DefaultSeriesChunkSize.
+	SeriesChunkSize int
+	// MaxSeries, if positive, is the maximum number of series a query may
+	// return. Responses are decoded a series at a time, and abandoned with a
+	// *SeriesLimitError as soon as the limit is exceeded, unless
+	// TruncateSeries is set, in which case the excess series are dropped, and
+	// a warning is added to the Warnings of the results. Only the decoded
+	// results are bounded; the body of the response is still read in full.
+	MaxSeries      int
+	TruncateSeries bool
+	// MaxRetries is the number of times a request is retried after a
+	// retryable failure (see IsRetryable) or, if RetryOnWarning is set, a
+	// response with a warning it matches. Zero disables retries.
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, which is doubled for
+	// each subsequent retry. Defaults to DefaultRetryBackoff.
+	RetryBackoff time.Duration
+	// RetryOnWarning, if set, is called with each warning of an otherwise
+	// successful response, and the request is retried if it returns true for
+	// any of them; e.g. for transient partial responses.
+	RetryOnWarning func(warning string) bool
+	// ResponseHeaders is an allowlist of response headers to capture into
+	// the Header of QueryResults; e.g. a proxy's cache status. Keep it small,
+	// as the headers are copied into every result.
+	ResponseHeaders []string
+	// TraceTimings records the duration of each phase of every request, such
+	// as the DNS lookup and TLS handshake, into the Timings of QueryResults.
+	TraceTimings bool
+	// HealthWindow is the period over which HealthStats are computed.
+	// Defaults to DefaultHealthWindow.
+	HealthWindow time.Duration
+	semaphore    *util.Semaphore
+	adaptive     *AdaptiveConcurrency
+	ping         pingResult
+	metadata     metadataCache
+	matchers     []LabelMatcher
+	inflight     inflightQueries
+	faults       *FaultInjection
+	health       healthCounter
+	tenants      tenantSemaphores
 }
 
-// NewContext creates a new Promethues querying context from the given client
-func NewContext(client prometheus.Client) *Context {
+// ContextOption configures a Context created by NewContext
+type ContextOption func(*Context)
+
+// NewContext creates a new Promethues querying context from the given client.
+// Every request is sent with the client; to configure timeouts or a Unix
+// socket, create the client with a RoundTripper from NewRoundTripper.
+func NewContext(client prometheus.Client, opts ...ContextOption) *Context {
 	var ec util.ErrorCollector
 
 	// By deafult, allow 20 concurrent queries, which is the Prometheus default
 	sem := util.NewSemaphore(20)
 
-	return &Context{
+	ctx := &Context{
 		Client:         client,
 		ErrorCollector: &ec,
+		QueryLogLength: DefaultQueryLogLength,
 		semaphore:      sem,
 	}
+
+	for _, opt := range opts {
+		opt(ctx)
+	}
+
+	if ctx.faults != nil {
+		ctx.Client = newFaultClient(ctx.Client, ctx.faults)
+	}
+
+	return ctx
 }
 
 // Errors returns the errors collected from the Context's ErrorCollector
@@ -43,70 +140,532 @@ func (ctx *Context) Errors() []error {
 	return ctx.ErrorCollector.Errors()
 }
 
-// TODO SetMaxConcurrency
+// MaxConcurrency returns the maximum number of queries the Context will run
+// concurrently
+func (ctx *Context) MaxConcurrency() int {
+	return ctx.semaphore.Max()
+}
+
+// SetMaxConcurrency sets the maximum number of queries the Context will run
+// concurrently. It is safe to call while queries are running; lowering the
+// limit does not interrupt queries which are already running.
+func (ctx *Context) SetMaxConcurrency(max int) {
+	if max < 1 {
+		max = 1
+	}
+
+	ctx.semaphore.SetMax(max)
+}
 
 // QueryAll returns one QueryResultsChan for each query provided, then runs
 // each query concurrently and returns results on each channel, respectively,
 // in the order they were provided; i.e. the response to queries[1] will be
 // sent on channel resChs[1].
+//
+// If QueryAllBatchSize is set, at most that many of the queries are in flight
+// at once, with each query starting as an earlier one completes, so that large
+// batches don't contend for the Context's concurrency all at once.
 func (ctx *Context) QueryAll(queries ...string) []QueryResultsChan {
 	resChs := []QueryResultsChan{}
 
-	for _, q := range queries {
-		resChs = append(resChs, ctx.Query(q))
+	if ctx.QueryAllBatchSize <= 0 || len(queries) <= ctx.QueryAllBatchSize {
+		for _, q := range queries {
+			resChs = append(resChs, ctx.Query(q))
+		}
+
+		return resChs
+	}
+
+	// Every query is tracked before QueryAll returns, so that CancelAll
+	// cancels those still waiting for their turn, which then stop as soon as
+	// they start
+	reqCtxs := make([]context.Context, len(queries))
+	dones := make([]func(), len(queries))
+	for i := range queries {
+		resChs = append(resChs, newQueryResultsChan())
+		reqCtxs[i], dones[i] = ctx.inflight.track(context.Background())
 	}
 
+	go func(ctx *Context, queries []string, resChs []QueryResultsChan) {
+		batch := util.NewSemaphore(ctx.QueryAllBatchSize)
+
+		for i, q := range queries {
+			batch.Acquire()
+
+			go func(i int, q string, resCh QueryResultsChan) {
+				defer batch.Return()
+				defer dones[i]()
+
+				resCh <- ctx.run(reqCtxs[i], epQuery, q, nil, nil)
+			}(i, q, resChs[i])
+		}
+	}(ctx, queries, resChs)
+
 	return resChs
 }
 
+// NamedResult is the results of one of the queries passed to QueryAllStream,
+// along with the name it was given
+type NamedResult struct {
+	Name    string
+	Results *QueryResults
+	Error   error
+}
+
+// QueryAllStream runs each of the given queries, keyed by name, concurrently,
+// and sends the results of each on the returned channel as soon as they are
+// available, in order of completion. As for QueryAll, the number in flight at
+// once is limited by QueryAllBatchSize, if set. The channel is closed once all
+// results have been sent or, if the context is done first, once the queries in
+// flight have stopped, in which case the results of canceled queries are not
+// sent.
+func (ctx *Context) QueryAllStream(reqCtx context.Context, queries map[string]string) <-chan NamedResult {
+	// Buffered for every result, so that abandoning the channel does not leak
+	// the goroutines sending on it
+	out := make(chan NamedResult, len(queries))
+
+	var batch *util.Semaphore
+	if ctx.QueryAllBatchSize > 0 {
+		batch = util.NewSemaphore(ctx.QueryAllBatchSize)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(queries))
+
+	for name, query := range queries {
+		// Tracked before returning, so that CancelAll cancels queries which
+		// are yet to start
+		tracked, done := ctx.inflight.track(reqCtx)
+
+		go func(name, query string) {
+			defer wg.Done()
+			defer done()
+
+			var qr *QueryResults
+			if batch != nil && batch.AcquireContext(tracked) != nil {
+				qr = canceledResults(query, tracked.Err())
+			} else {
+				if batch != nil {
+					defer batch.Return()
+				}
+				qr = ctx.run(tracked, epQuery, query, nil, nil)
+			}
+
+			if reqCtx.Err() != nil {
+				return
+			}
+
+			out <- NamedResult{Name: name, Results: qr, Error: qr.Error}
+		}(name, query)
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out
+}
+
 // Query returns a QueryResultsChan, then runs the given query and sends the
 // results on the provided channel. Receiver is responsible for closing the
-// channel, preferably using the Read method.
+// channel, preferably using the Await method. The channel is buffered, so the
+// goroutine running the query exits as soon as results are sent, even if the
+// channel is never read; an abandoned channel is simply garbage collected.
 func (ctx *Context) Query(query string) QueryResultsChan {
-	resCh := make(QueryResultsChan)
+	return ctx.QueryWithParams(query, nil)
+}
 
-	go func(ctx *Context, resCh QueryResultsChan) {
-		raw, promErr := ctx.query(query)
-		ctx.ErrorCollector.Report(promErr)
+// QueryContext behaves like Query, but stops waiting for access or a response
+// once the given context is done, in which case the channel receives results
+// with a QueryError wrapping a CanceledError. Cancellations are not reported
+// to the ErrorCollector.
+func (ctx *Context) QueryContext(reqCtx context.Context, query string) QueryResultsChan {
+	return ctx.async(reqCtx, epQuery, query, nil, nil)
+}
+
+// QueryWithCancel behaves like Query, but also returns a function which
+// cancels just this query, releasing its place in the queue (or its access, if
+// running) without affecting any other query. See QueryContext.
+func (ctx *Context) QueryWithCancel(query string) (QueryResultsChan, context.CancelFunc) {
+	reqCtx, cancel := context.WithCancel(context.Background())
+	return ctx.QueryContext(reqCtx, query), cancel
+}
 
-		results, parseErr := NewQueryResults(raw)
-		ctx.ErrorCollector.Report(parseErr)
+// QueryWithParams behaves like Query, but adds the given parameters to the
+// request for this query only. Parameters are merged with the following
+// precedence, highest first: params given to this call, the Context's
+// ExtraParams, the Context's defaults (e.g. LookbackDelta), then any
+// parameters set by the package itself. The query parameter is always set
+// to the given query and cannot be overridden.
+func (ctx *Context) QueryWithParams(query string, params url.Values) QueryResultsChan {
+	return ctx.async(context.Background(), epQuery, query, nil, params)
+}
+
+// QueryWithLookbackDelta behaves like Query, but overrides the lookback delta
+// for this query only, taking precedence over the Context's LookbackDelta.
+func (ctx *Context) QueryWithLookbackDelta(query string, lookbackDelta time.Duration) QueryResultsChan {
+	err := validateLookbackDelta(lookbackDelta)
+	if err != nil {
+		return ctx.failed(query, fmt.Errorf("Error %s for query %s", err.Error(), query))
+	}
+
+	return ctx.QueryWithParams(query, url.Values{
+		paramLookbackDelta: []string{formatDuration(lookbackDelta)},
+	})
+}
+
+func validateLookbackDelta(lookbackDelta time.Duration) error {
+	if lookbackDelta <= 0 {
+		return fmt.Errorf("lookback delta must be positive (lookback delta: %s)", lookbackDelta)
+	}
 
-		resCh <- results
+	return nil
+}
+
+// async returns a QueryResultsChan, then runs the given query against the
+// given endpoint and sends the results on the channel. Parameters set by the
+// package are given as builtin, and those given by the caller as params.
+func (ctx *Context) async(reqCtx context.Context, ep string, query string, builtin url.Values, params url.Values) QueryResultsChan {
+	// Sending never blocks, preventing the goroutine from leaking if the
+	// receiver abandons the channel
+	resCh := newQueryResultsChan()
+
+	// Tracked before returning, so that CancelAll cancels the query even if
+	// its goroutine is yet to start
+	reqCtx, done := ctx.inflight.track(reqCtx)
+
+	go func(ctx *Context, resCh QueryResultsChan) {
+		defer done()
+		resCh <- ctx.run(reqCtx, ep, query, builtin, params)
 	}(ctx, resCh)
 
 	return resCh
 }
 
-func (ctx *Context) query(query string) (interface{}, error) {
-	ctx.semaphore.Acquire()
-	defer ctx.semaphore.Return()
+// run runs the given query against the given endpoint, blocking until the
+// results are available, and reports any errors to the ErrorCollector. The
+// caller is responsible for tracking reqCtx, so that CancelAll applies.
+func (ctx *Context) run(reqCtx context.Context, ep string, query string, builtin url.Values, params url.Values) *QueryResults {
+	qr := &QueryResults{Query: query}
+
+	raw, meta, promErr := ctx.query(reqCtx, ep, query, builtin, params)
+	if meta != nil {
+		qr.Header = meta.header
+		qr.Timings = meta.timings
+		qr.Warnings = meta.warnings
+	}
+	if promErr != nil {
+		if reqCtx.Err() != nil {
+			qr.Error = &QueryError{Query: query, Err: &CanceledError{Query: query, Err: reqCtx.Err()}}
+		} else {
+			qr.Error = &QueryError{Query: query, Err: promErr}
+			ctx.ErrorCollector.Report(qr.Error)
+		}
+
+		return qr
+	}
 
-	u := ctx.Client.URL(epQuery, nil)
+	results, parseErr := NewQueryResults(raw)
+	if parseErr != nil {
+		// Errors reported by Prometheus are failures of the query, not of
+		// parsing its response
+		var ae *APIError
+		if errors.As(parseErr, &ae) {
+			qr.Error = &QueryError{Query: query, Err: fmt.Errorf("Error %w fetching query %s", ae, query)}
+		} else {
+			qr.Error = &ParseError{Query: query, Err: parseErr}
+		}
+		ctx.ErrorCollector.Report(qr.Error)
+	}
+	qr.Results = results
+
+	return qr
+}
+
+// failed reports the error and returns a QueryResultsChan which immediately
+// yields empty results, for queries which could not be run
+func (ctx *Context) failed(query string, err error) QueryResultsChan {
+	qe := &QueryError{Query: query, Err: err}
+	ctx.ErrorCollector.Report(qe)
+
+	resCh := newQueryResultsChan()
+	resCh <- &QueryResults{Query: query, Error: qe}
+	return resCh
+}
+
+func (ctx *Context) query(reqCtx context.Context, ep string, query string, builtin url.Values, params url.Values) (interface{}, *responseMeta, error) {
+	qp, err := ctx.queryParams(builtin, params)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error %s for query %s", err.Error(), query)
+	}
+
+	body, meta, err := ctx.send(reqCtx, http.MethodPost, ep, query, qp)
+	if err != nil {
+		return nil, meta, err
+	}
+
+	// Responses which are not objects are left to fail below
+	if ctx.MaxSeries > 0 && bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		toReturn, warning, err := ctx.decodeLimited(query, body)
+		if warning != "" && meta != nil {
+			meta.warnings = append(meta.warnings, warning)
+		}
+		return toReturn, meta, err
+	}
+
+	var toReturn interface{}
+	err = json.Unmarshal(body, &toReturn)
+	if err != nil {
+		return nil, meta, fmt.Errorf("Error %s fetching query %s", err.Error(), query)
+	}
+
+	// All Prometheus API responses are objects carrying a status field
+	m, ok := toReturn.(map[string]interface{})
+	if !ok {
+		return nil, meta, &NotPrometheusError{URL: ctx.Client.URL(ep, nil).String(), Reason: "response is not a JSON object"}
+	}
+	if _, ok := m["status"].(string); !ok {
+		return nil, meta, &NotPrometheusError{URL: ctx.Client.URL(ep, nil).String(), Reason: "response has no status field"}
+	}
+
+	return toReturn, meta, nil
+}
+
+// request runs a POST against the given endpoint, passing the query (if not
+// empty) and any additional parameters, and returns the body of the response.
+// Transport errors and non-JSON responses are returned as errors.
+func (ctx *Context) request(reqCtx context.Context, ep string, query string, params url.Values) ([]byte, error) {
+	return ctx.requestMethod(reqCtx, http.MethodPost, ep, query, params)
+}
+
+// requestMethod behaves like request, using the given HTTP method, for the
+// endpoints which do not accept a POST
+func (ctx *Context) requestMethod(reqCtx context.Context, method string, ep string, query string, params url.Values) ([]byte, error) {
+	body, _, err := ctx.send(reqCtx, method, ep, query, params)
+	return body, err
+}
+
+// responseMeta describes the response to the final attempt of a request, as
+// captured into QueryResults
+type responseMeta struct {
+	header   http.Header
+	timings  *PhaseTimings
+	warnings []string
+}
+
+// send behaves like requestMethod, additionally returning the response headers
+// allowed by ResponseHeaders, if any, and the phase timings, if traced, of the
+// final attempt
+func (ctx *Context) send(reqCtx context.Context, method string, ep string, query string, params url.Values) ([]byte, *responseMeta, error) {
+	if query != "" && len(ctx.matchers) > 0 {
+		injected, err := InjectMatchers(query, ctx.matchers)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error %s injecting label matchers into query %s", err.Error(), query)
+		}
+		query = injected
+	}
+
+	if ctx.MaxQueryLength > 0 && len(query) > ctx.MaxQueryLength {
+		return nil, nil, fmt.Errorf("Error query length %d exceeds maximum query length %d for query %s", len(query), ctx.MaxQueryLength, ctx.loggable(query))
+	}
+
+	// subject and logSubject describe the request in errors and logs, respectively
+	subject, logSubject := ep, ep
+	if query != "" {
+		subject = "query " + query
+		logSubject = "query " + ctx.loggable(query)
+	}
+
+	u := ctx.Client.URL(ep, nil)
 	q := u.Query()
-	q.Set("query", query)
+	for k, vs := range params {
+		q[k] = vs
+	}
+	if query != "" {
+		q.Set("query", query)
+	}
 	u.RawQuery = q.Encode()
 
-	req, err := http.NewRequest(http.MethodPost, u.String(), nil)
+	for attempt := 0; ; attempt++ {
+		body, meta, warnings, err := ctx.attempt(reqCtx, method, u.String(), ep, query, subject)
+
+		retry := false
+		if err != nil {
+			retry = IsRetryable(err)
+		} else {
+			retry = ctx.retryOnWarning(warnings)
+		}
+
+		if !retry || attempt >= ctx.MaxRetries {
+			for _, w := range warnings {
+				if attempt > 0 {
+					klog.V(1).Infof("[Warning] Warning '%s' fetching %s after %d retries", w, logSubject, attempt)
+				} else {
+					klog.V(3).Infof("Warning '%s' fetching %s", w, logSubject)
+				}
+			}
+
+			ctx.recordHealth(attempt, err)
+
+			return body, meta, err
+		}
+
+		// Errors are not logged, as they may contain the query itself
+		if err != nil {
+			klog.V(3).Infof("Retrying %s after error", logSubject)
+		} else {
+			klog.V(3).Infof("Retrying %s after warnings: %s", logSubject, strings.Join(warnings, "; "))
+		}
+
+		if err := ctx.waitRetry(reqCtx, attempt); err != nil {
+			ctx.recordHealth(attempt, err)
+			return nil, meta, err
+		}
+	}
+}
+
+// attempt makes a single request to the URL, holding access to the semaphore,
+// and that of its tenant, only for its duration
+func (ctx *Context) attempt(reqCtx context.Context, method string, u string, ep string, query string, subject string) ([]byte, *responseMeta, prometheus.Warnings, error) {
+	release, err := ctx.acquire(reqCtx)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
+	defer release()
 
-	resp, body, warnings, err := ctx.Client.Do(context.Background(), req)
-	for _, w := range warnings {
-		klog.V(3).Infof("Warning '%s' fetching query '%s'", w, query)
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var tracer *phaseTracer
+	if ctx.TraceTimings {
+		tracer = &phaseTracer{}
+		reqCtx = httptrace.WithClientTrace(reqCtx, tracer.trace())
 	}
+
+	start := time.Now()
+	resp, body, warnings, err := ctx.Client.Do(reqCtx, req)
+	ctx.observe(start, resp, err)
+
+	meta := &responseMeta{header: ctx.responseHeader(resp)}
+	if tracer != nil {
+		meta.timings = tracer.timings(start, time.Now())
+	}
+
 	if err != nil {
 		if resp == nil {
-			return nil, fmt.Errorf("Error %s fetching query %s", err.Error(), query)
+			return nil, meta, warnings, fmt.Errorf("Error %w fetching %s", err, subject)
 		}
 
-		return nil, fmt.Errorf("%d Error %s fetching query %s", resp.StatusCode, err.Error(), query)
+		return nil, meta, warnings, fmt.Errorf("%d Error %w fetching %s", resp.StatusCode, err, subject)
 	}
-	var toReturn interface{}
-	err = json.Unmarshal(body, &toReturn)
+
+	// Clients which request compression themselves, rather than leaving it to
+	// the Go transport or a RoundTripper from NewRoundTripper, return bodies
+	// still encoded
+	body, err = decodeContentEncoding(resp, body)
 	if err != nil {
-		return nil, fmt.Errorf("Error %s fetching query %s", err.Error(), query)
+		return nil, meta, warnings, fmt.Errorf("%d Error %w fetching %s", resp.StatusCode, err, subject)
+	}
+	if isNonJSONResponse(resp, body) {
+		return nil, meta, warnings, NewUpstreamError(ep, query, resp, body)
+	}
+
+	// Prometheus returns warnings in the body of the response, rather than
+	// in anything the client reads
+	warnings = append(warnings, responseWarnings(body)...)
+	meta.warnings = warnings
+
+	return body, meta, warnings, nil
+}
+
+// responseWarnings returns the warnings field of the response body, if any
+func responseWarnings(body []byte) []string {
+	var envelope struct {
+		Warnings []string `json:"warnings"`
+	}
+	if json.Unmarshal(body, &envelope) != nil {
+		return nil
+	}
+
+	return envelope.Warnings
+}
+
+// responseHeader returns the headers of the response allowed by
+// ResponseHeaders, or nil if there are none
+func (ctx *Context) responseHeader(resp *http.Response) http.Header {
+	if resp == nil || len(ctx.ResponseHeaders) == 0 {
+		return nil
+	}
+
+	var header http.Header
+	for _, name := range ctx.ResponseHeaders {
+		key := http.CanonicalHeaderKey(name)
+		vs := resp.Header[key]
+		if len(vs) == 0 {
+			continue
+		}
+		if header == nil {
+			header = http.Header{}
+		}
+		header[key] = append([]string(nil), vs...)
 	}
-	return toReturn, nil
+
+	return header
+}
+
+// queryParams returns the parameters for a query, merging, in order of
+// increasing precedence: those set by the package, the Context's defaults
+// (e.g. LookbackDelta), the Context's ExtraParams, and those given by the
+// caller.
+func (ctx *Context) queryParams(builtin url.Values, params url.Values) (url.Values, error) {
+	defaults := url.Values{}
+
+	if ctx.LookbackDelta != 0 {
+		err := validateLookbackDelta(ctx.LookbackDelta)
+		if err != nil {
+			return nil, err
+		}
+		defaults.Set(paramLookbackDelta, formatDuration(ctx.LookbackDelta))
+	}
+
+	return mergeParams(builtin, defaults, ctx.ExtraParams, params), nil
+}
+
+// mergeParams returns a new set of parameters containing each of the given
+// sets, in order, such that a key in a later set replaces all values for
+// that key in earlier sets
+func mergeParams(sets ...url.Values) url.Values {
+	merged := url.Values{}
+	for _, set := range sets {
+		for k, vs := range set {
+			merged[k] = append([]string(nil), vs...)
+		}
+	}
+
+	return merged
+}
+
+// loggable returns the form of the query which should appear in log messages,
+// as configured by QueryLogLength and QueryLogHash
+func (ctx *Context) loggable(query string) string {
+	if ctx.QueryLogHash {
+		// Hash the normalized query, so that log lines of queries which
+		// differ only cosmetically correlate
+		sum := sha256.Sum256([]byte(NormalizeQuery(query)))
+		return fmt.Sprintf("sha256:%x (%d chars)", sum[:8], len(query))
+	}
+
+	if ctx.QueryLogLength <= 0 || len(query) <= ctx.QueryLogLength {
+		return query
+	}
+
+	runes := []rune(query)
+	if len(runes) <= ctx.QueryLogLength {
+		return query
+	}
+
+	return fmt.Sprintf("%s...(%d more chars)", string(runes[:ctx.QueryLogLength]), len(runes)-ctx.QueryLogLength)
 }
@@ -0,0 +1,99 @@
+package prom
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	epQueryRange = apiPrefix + "/query_range"
+)
+
+// MaxRangePoints is the maximum number of points per series a range query may
+// request, i.e. (end - start) / step, which matches the limit Prometheus
+// enforces on the server.
+const MaxRangePoints = 11000
+
+// QueryRange returns a QueryResultsChan, then runs the given query over the
+// range [start, end] at the given resolution and sends the results on the
+// channel. As with Query, the receiver is responsible for closing the channel.
+// An invalid range is reported without making a request; see ValidateRange.
+func (ctx *Context) QueryRange(query string, start, end time.Time, step time.Duration) QueryResultsChan {
+	err := ValidateRange(start, end, step)
+	if err != nil {
+		return ctx.failed(query, fmt.Errorf("Error %s for query %s", err.Error(), query))
+	}
+
+	return ctx.async(context.Background(), epQueryRange, query, rangeParams(start, end, step), nil)
+}
+
+// QueryRangeWithFallback behaves like QueryRange, but if the range query
+// succeeds without returning any series, falls back to an instant query
+// evaluated at end, whose results are sent in its place; i.e. each series
+// holds a single sample. A range query which fails is not retried.
+func (ctx *Context) QueryRangeWithFallback(query string, start, end time.Time, step time.Duration) QueryResultsChan {
+	resCh := newQueryResultsChan()
+
+	go func(ctx *Context, resCh QueryResultsChan) {
+		qr := ctx.QueryRange(query, start, end, step).AwaitResults()
+		if qr.Error != nil || len(qr.Results) > 0 {
+			resCh <- qr
+			return
+		}
+
+		klog.V(4).Infof("Range query returned no series, falling back to instant query %s", ctx.loggable(query))
+
+		instant := url.Values{"time": []string{formatTime(end)}}
+		resCh <- ctx.async(context.Background(), epQuery, query, instant, nil).AwaitResults()
+	}(ctx, resCh)
+
+	return resCh
+}
+
+// ValidateRange returns an error if the range and step cannot produce a valid
+// range query: start must be before end, step must be positive, and the range
+// divided by the step must not exceed MaxRangePoints, as Prometheus checks.
+func ValidateRange(start, end time.Time, step time.Duration) error {
+	if !start.Before(end) {
+		return fmt.Errorf("start must be before end (start: %s, end: %s)", start.Format(time.RFC3339), end.Format(time.RFC3339))
+	}
+
+	if step <= 0 {
+		return fmt.Errorf("step must be positive (step: %s)", step)
+	}
+
+	// Prometheus compares the range over the step, rather than the number of
+	// points, which includes both ends and so is one more
+	steps := int64(end.Sub(start) / step)
+	if steps > MaxRangePoints {
+		return fmt.Errorf("range of %s at step %s requests %d steps, exceeding the maximum of %d", end.Sub(start), step, steps, MaxRangePoints)
+	}
+
+	return nil
+}
+
+// rangeParams returns the query_range parameters for the given range and step
+func rangeParams(start, end time.Time, step time.Duration) url.Values {
+	return url.Values{
+		"start": []string{formatTime(start)},
+		"end":   []string{formatTime(end)},
+		"step":  []string{formatDuration(step)},
+	}
+}
+
+// formatTime formats the time as fractional seconds since the epoch, as
+// accepted by the Prometheus API
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', -1, 64)
+}
+
+// formatDuration formats the duration as fractional seconds, as accepted by
+// the Prometheus API
+func formatDuration(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
@@ -0,0 +1,86 @@
+package prom
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/kubecost/cost-model/pkg/util"
+)
+
+// RangeResult is the series of samples of a single result of a range query,
+// ordered by timestamp
+type RangeResult []*util.Vector
+
+// Range returns the values of the result as a RangeResult, sorted by timestamp
+func (qr *QueryResult) Range() RangeResult {
+	rr := make(RangeResult, len(qr.Values))
+	copy(rr, qr.Values)
+	sort.Sort(util.VectorSlice(rr))
+
+	return rr
+}
+
+// Resets returns the timestamps of the samples at which the value dropped
+// below that of the previous sample, which, for a counter, indicates that the
+// counter was reset; e.g. by a restart of the process exposing it.
+func (rr RangeResult) Resets() []time.Time {
+	resets := []time.Time{}
+
+	for i := 1; i < len(rr); i++ {
+		if rr[i].Value < rr[i-1].Value {
+			resets = append(resets, vectorTime(rr[i]))
+		}
+	}
+
+	return resets
+}
+
+// Clip returns the samples within [start, end]. Both bounds are inclusive, as
+// are those of a range query, so a sample exactly at start or end is kept.
+//
+// Bounds are compared with the timestamps of the samples as parsed, which
+// NewQueryResults rounds to the nearest 10 seconds, so a sample up to 5s
+// outside a bound may be kept, and one up to 5s inside it dropped. Align
+// bounds and query steps to 10s to avoid this. To clip to a half-open window
+// [start, end), such as consecutive windows which must not share a sample,
+// pass an end earlier by less than 10s, e.g. one second. The samples are not
+// copied.
+func (rr RangeResult) Clip(start, end time.Time) RangeResult {
+	clipped := RangeResult{}
+
+	for _, v := range rr {
+		t := vectorTime(v)
+		if t.Before(start) || t.After(end) {
+			continue
+		}
+		clipped = append(clipped, v)
+	}
+
+	return clipped
+}
+
+// Clip returns a copy of the results with each series limited to the samples
+// within [start, end], with the same boundary semantics as RangeResult.Clip.
+// Series left without samples are kept, with no values. Metrics and samples
+// are shared with the original results.
+func (qr *QueryResults) Clip(start, end time.Time) *QueryResults {
+	clipped := qr.withResults(make([]*QueryResult, 0, len(qr.Results)))
+
+	for _, result := range qr.Results {
+		clipped.Results = append(clipped.Results, &QueryResult{
+			Metric: result.Metric,
+			Values: RangeResult(result.Values).Clip(start, end),
+		})
+	}
+
+	return clipped
+}
+
+// vectorTime converts the timestamp of the vector, in seconds, to a Time. It
+// is rounded to the nearest microsecond, as a float64 of seconds since the epoch
+// cannot represent finer intervals exactly.
+func vectorTime(v *util.Vector) time.Time {
+	sec, frac := math.Modf(v.Timestamp)
+	return time.Unix(int64(sec), int64(math.Round(frac*1e6))*1e3)
+}
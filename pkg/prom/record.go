@@ -0,0 +1,242 @@
+package prom
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	prometheus "github.com/prometheus/client_golang/api"
+	"k8s.io/klog"
+)
+
+// Record is a single request and its raw response, as written by a
+// RecordingClient and served by a ReplayClient
+type Record struct {
+	Endpoint    string     `json:"endpoint"`
+	Query       string     `json:"query,omitempty"`
+	Params      url.Values `json:"params"`
+	StatusCode  int        `json:"statusCode,omitempty"`
+	ContentType string     `json:"contentType,omitempty"`
+	Warnings    []string   `json:"warnings,omitempty"`
+	Body        string     `json:"body,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// key identifies the request of the record, such that identical requests
+// share a key
+func (r *Record) key() string {
+	return r.Endpoint + "?" + r.Params.Encode()
+}
+
+// RecordingClient wraps a prometheus.Client, writing each request and its raw
+// response to a writer as a line of JSON. Recordings can be served back with
+// a ReplayClient. Failing to write a record is logged, but does not fail the
+// request.
+type RecordingClient struct {
+	prometheus.Client
+	m   sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+	err error
+}
+
+// NewRecordingClient creates a new RecordingClient, which records requests
+// made with the given client to w
+func NewRecordingClient(client prometheus.Client, w io.Writer) *RecordingClient {
+	return &RecordingClient{
+		Client: client,
+		w:      w,
+		enc:    json.NewEncoder(w),
+	}
+}
+
+// Do runs the request with the wrapped client and records the result
+func (rc *RecordingClient) Do(ctx context.Context, req *http.Request) (*http.Response, []byte, prometheus.Warnings, error) {
+	params, err := RequestParams(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	resp, body, warnings, err := rc.Client.Do(ctx, req)
+
+	// Record endpoints relative to the client's base path, so that recordings
+	// can be replayed regardless of where Prometheus was served from
+	base := strings.TrimSuffix(rc.Client.URL("", nil).Path, "/")
+
+	rec := &Record{
+		Endpoint: strings.TrimPrefix(req.URL.Path, base),
+		Query:    params.Get("query"),
+		Params:   params,
+		Warnings: warnings,
+		Body:     string(body),
+	}
+	if resp != nil {
+		rec.StatusCode = resp.StatusCode
+		rec.ContentType = resp.Header.Get("Content-Type")
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	rc.m.Lock()
+	encErr := rc.enc.Encode(rec)
+	if encErr != nil && rc.err == nil {
+		rc.err = encErr
+	}
+	rc.m.Unlock()
+
+	if encErr != nil {
+		klog.V(1).Infof("[Warning] Failed to record request to %s: %s", rec.Endpoint, encErr)
+	}
+
+	return resp, body, warnings, err
+}
+
+// Err returns the first error encountered writing a record, if any
+func (rc *RecordingClient) Err() error {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+
+	return rc.err
+}
+
+// ReplayClient is a prometheus.Client which serves the responses recorded by a
+// RecordingClient instead of making requests. Requests are matched to records
+// by endpoint and parameters. When a request was recorded more than once, the
+// responses are served in the order they were recorded, repeating the last
+// once exhausted. Requests which were never recorded return an error.
+type ReplayClient struct {
+	m       sync.Mutex
+	records map[string][]*Record
+}
+
+// NewReplayClient creates a new ReplayClient from the records read from r
+func NewReplayClient(r io.Reader) (*ReplayClient, error) {
+	rc := &ReplayClient{
+		records: map[string][]*Record{},
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var rec Record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error %s reading query recording", err.Error())
+		}
+
+		key := rec.key()
+		rc.records[key] = append(rc.records[key], &rec)
+	}
+
+	return rc, nil
+}
+
+// NewReplayContext creates a new Context which serves the responses recorded
+// in r, rather than querying Prometheus
+func NewReplayContext(r io.Reader) (*Context, error) {
+	rc, err := NewReplayClient(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewContext(rc), nil
+}
+
+// URL builds URLs against a placeholder host, as only the path and parameters
+// of requests are used to match records
+func (rc *ReplayClient) URL(ep string, args map[string]string) *url.URL {
+	p := ep
+	for arg, val := range args {
+		p = strings.Replace(p, ":"+arg, val, -1)
+	}
+
+	return &url.URL{
+		Scheme: "http",
+		Host:   "replay",
+		Path:   p,
+	}
+}
+
+// Do serves the recorded response matching the request
+func (rc *ReplayClient) Do(ctx context.Context, req *http.Request) (*http.Response, []byte, prometheus.Warnings, error) {
+	params, err := RequestParams(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	probe := &Record{Endpoint: req.URL.Path, Params: params}
+	key := probe.key()
+
+	rc.m.Lock()
+	recs := rc.records[key]
+	if len(recs) == 0 {
+		rc.m.Unlock()
+		return nil, nil, nil, fmt.Errorf("no recorded response for request to %s with query '%s'", probe.Endpoint, params.Get("query"))
+	}
+	rec := recs[0]
+	if len(recs) > 1 {
+		rc.records[key] = recs[1:]
+	}
+	rc.m.Unlock()
+
+	if rec.Error != "" {
+		return nil, nil, prometheus.Warnings(rec.Warnings), fmt.Errorf("%s", rec.Error)
+	}
+
+	header := http.Header{}
+	if rec.ContentType != "" {
+		header.Set("Content-Type", rec.ContentType)
+	}
+
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%d %s", rec.StatusCode, http.StatusText(rec.StatusCode)),
+		StatusCode: rec.StatusCode,
+		Header:     header,
+		Body:       ioutil.NopCloser(strings.NewReader(rec.Body)),
+		Request:    req,
+	}
+
+	return resp, []byte(rec.Body), prometheus.Warnings(rec.Warnings), nil
+}
+
+// RequestParams returns the URL query parameters of the request, merged with
+// any form-encoded parameters in its body, as the Context sends them. The body
+// is restored after reading, so the request can still be sent.
+func RequestParams(req *http.Request) (url.Values, error) {
+	params := req.URL.Query()
+
+	if req.Body == nil || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return params, nil
+	}
+
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	form, err := url.ParseQuery(string(b))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, vs := range form {
+		for _, v := range vs {
+			params.Add(k, v)
+		}
+	}
+
+	return params, nil
+}
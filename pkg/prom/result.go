@@ -1,23 +1,201 @@
 package prom
 
 import (
+	"errors"
 	"fmt"
 	"math"
+	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/kubecost/cost-model/pkg/util"
 	"k8s.io/klog"
 )
 
-// QueryResultsChan is a channel of query results
-type QueryResultsChan chan []*QueryResult
+// QueryResultsChan is a channel of query results. Each channel carries the
+// results of a single query, and is buffered to hold them, so that the
+// goroutine producing them (and its access to the Context) is released as
+// soon as they are available, however slowly the channel is read. The
+// trade-off is that results sent but not yet received are held in memory
+// until the channel is read or garbage collected.
+type QueryResultsChan chan *QueryResults
+
+// newQueryResultsChan creates a QueryResultsChan with room for its results,
+// so that sending them never blocks
+func newQueryResultsChan() QueryResultsChan {
+	return make(QueryResultsChan, 1)
+}
 
 // Await returns query results, blocking until they are made available, and
 // deferring the closure of the underlying channel
 func (qrc QueryResultsChan) Await() []*QueryResult {
+	return qrc.AwaitResults().Results
+}
+
+// AwaitResults returns the QueryResults, blocking until they are made
+// available, and deferring the closure of the underlying channel. The
+// returned QueryResults is never nil.
+func (qrc QueryResultsChan) AwaitResults() *QueryResults {
 	defer close(qrc)
-	return <-qrc
+
+	qr := <-qrc
+	if qr == nil {
+		return &QueryResults{}
+	}
+	return qr
+}
+
+// QueryResults contains all of the results of a single query, and the error
+// which prevented the query from completing, if any. A failure to fetch the
+// query is a *QueryError, and a failure to parse its response a *ParseError.
+// Prefer traversing the results with Iterator over accessing Results directly.
+type QueryResults struct {
+	Query   string
+	Results []*QueryResult
+	Error   error
+	// Header contains the response headers allowed by the Context's
+	// ResponseHeaders, if any were present
+	Header http.Header
+	// Timings contains the phase timings of the request, if the Context's
+	// TraceTimings is set
+	Timings *PhaseTimings
+	// Warnings contains the warnings returned by Prometheus with the results,
+	// such as of a partial response, after any retries
+	Warnings []string
+}
+
+// withResults returns a copy of the results carrying the given results in
+// place of its own, and everything else about the query, such as its error and
+// warnings, as is. It is used by the methods deriving new results from a
+// query's, so that none of them drop a field.
+func (qr *QueryResults) withResults(results []*QueryResult) *QueryResults {
+	derived := *qr
+	derived.Results = results
+	return &derived
+}
+
+// IsQueryError returns true if the query could not be fetched
+func (qr *QueryResults) IsQueryError() bool {
+	var qe *QueryError
+	return errors.As(qr.Error, &qe)
+}
+
+// IsParseError returns true if the query was fetched, but its response could
+// not be parsed
+func (qr *QueryResults) IsParseError() bool {
+	var pe *ParseError
+	return errors.As(qr.Error, &pe)
+}
+
+// Len returns the number of series in the results
+func (qr *QueryResults) Len() int {
+	if qr == nil {
+		return 0
+	}
+	return len(qr.Results)
+}
+
+// Iterator returns a ResultIterator over the series of the results, which is
+// the preferred way to traverse them, rather than accessing Results directly,
+// so that callers are not coupled to how results are stored; e.g.
+//
+//	it := qr.Iterator()
+//	for it.Next() {
+//		result := it.Result()
+//		...
+//	}
+func (qr *QueryResults) Iterator() *ResultIterator {
+	it := &ResultIterator{index: -1}
+	if qr != nil {
+		it.results = qr.Results
+	}
+	return it
+}
+
+// ResultIterator traverses the series of QueryResults in order. It must be
+// advanced with Next before reading the first result.
+type ResultIterator struct {
+	results []*QueryResult
+	index   int
+}
+
+// Next advances the iterator to the next series, returning false once there
+// are no more
+func (it *ResultIterator) Next() bool {
+	if it.index < len(it.results) {
+		it.index++
+	}
+	return it.index < len(it.results)
+}
+
+// Result returns the current series, or nil if the iterator is not positioned
+// on one
+func (it *ResultIterator) Result() *QueryResult {
+	if it.index < 0 || it.index >= len(it.results) {
+		return nil
+	}
+	return it.results[it.index]
+}
+
+// ExpectSingle returns the only series of the results, or an error if the
+// query failed, or if there is not exactly one series with exactly one sample;
+// e.g. for queries expected to yield a single number.
+func (qr *QueryResults) ExpectSingle() (*QueryResult, error) {
+	if qr.Error != nil {
+		return nil, qr.Error
+	}
+
+	if len(qr.Results) != 1 {
+		return nil, fmt.Errorf("Expected exactly one series, found %d, for query %s", len(qr.Results), qr.Query)
+	}
+
+	result := qr.Results[0]
+	if len(result.Values) != 1 {
+		return nil, fmt.Errorf("Expected exactly one sample, found %d, for query %s", len(result.Values), qr.Query)
+	}
+
+	return result, nil
+}
+
+// IndexedResult contains the results received on one of the channels passed
+// to Merge, along with the index of that channel
+type IndexedResult struct {
+	Index   int
+	Results *QueryResults
+	Error   error
+}
+
+// Merge fans in the given channels, sending the results of each on the
+// returned channel as soon as they are available, tagged with the index of the
+// channel they were received on. Results are sent in order of arrival, not in
+// order of index. Each of the given channels is closed once read, and the
+// returned channel is closed once all results have been sent.
+func Merge(chans []QueryResultsChan) <-chan IndexedResult {
+	merged := make(chan IndexedResult, len(chans))
+
+	var wg sync.WaitGroup
+	wg.Add(len(chans))
+
+	for i, ch := range chans {
+		go func(i int, ch QueryResultsChan) {
+			defer wg.Done()
+
+			qr := ch.AwaitResults()
+			merged <- IndexedResult{
+				Index:   i,
+				Results: qr,
+				Error:   qr.Error,
+			}
+		}(i, ch)
+	}
+
+	go func() {
+		wg.Wait()
+		close(merged)
+	}()
+
+	return merged
 }
 
 // QueryResult contains a single result from a prometheus query. It's common
@@ -29,18 +207,32 @@ type QueryResult struct {
 
 // NewQueryResults accepts the raw prometheus query result and returns an array of
 // QueryResult objects
+//
+// A response with status "error" returns an *APIError carrying the errorType
+// reported by Prometheus, while a successful response without any results
+// returns an empty, non-nil slice and no error.
 func NewQueryResults(queryResult interface{}) ([]*QueryResult, error) {
-	var result []*QueryResult
+	result := []*QueryResult{}
 	if queryResult == nil {
 		return nil, fmt.Errorf("[Error] nil result from prometheus, has it gone down?")
 	}
-	data, ok := queryResult.(map[string]interface{})["data"]
+	qr, ok := queryResult.(map[string]interface{})
 	if !ok {
-		e, err := wrapPrometheusError(queryResult)
-		if err != nil {
-			return nil, err
-		}
-		return nil, fmt.Errorf(e)
+		return nil, fmt.Errorf("Unexpected response from Prometheus")
+	}
+
+	status, _ := qr["status"].(string)
+	switch status {
+	case "success":
+	case "error":
+		return nil, newAPIError(qr)
+	default:
+		return nil, fmt.Errorf("Unexpected response status '%s' from Prometheus", status)
+	}
+
+	data, ok := qr["data"]
+	if !ok {
+		return nil, fmt.Errorf("Data field not present in prometheus response")
 	}
 
 	// Deep Check for proper formatting
@@ -190,11 +382,14 @@ func labelsForMetric(metricMap map[string]interface{}) string {
 	return fmt.Sprintf("{%s}", strings.Join(pairs, ", "))
 }
 
-func wrapPrometheusError(qr interface{}) (string, error) {
-	e, ok := qr.(map[string]interface{})["error"]
-	if !ok {
-		return "", fmt.Errorf("Unexpected response from Prometheus")
+// newAPIError creates an APIError from the error and errorType fields of a
+// response with status "error"
+func newAPIError(qr map[string]interface{}) *APIError {
+	errorType, _ := qr["errorType"].(string)
+	message, _ := qr["error"].(string)
+
+	return &APIError{
+		ErrorType: errorType,
+		Message:   message,
 	}
-	eStr, ok := e.(string)
-	return eStr, nil
 }
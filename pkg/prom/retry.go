@@ -0,0 +1,46 @@
+package prom
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultRetryBackoff is the delay before the first retry of a request, when
+// the Context does not set RetryBackoff
+const DefaultRetryBackoff = 500 * time.Millisecond
+
+// retryOnWarning returns true if RetryOnWarning is set and matches any of the
+// warnings
+func (ctx *Context) retryOnWarning(warnings []string) bool {
+	if ctx.RetryOnWarning == nil {
+		return false
+	}
+
+	for _, w := range warnings {
+		if ctx.RetryOnWarning(w) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// waitRetry blocks for the backoff preceding the retry after the given
+// attempt, returning early with the context's error if it is done first
+func (ctx *Context) waitRetry(reqCtx context.Context, attempt int) error {
+	backoff := ctx.RetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	backoff <<= uint(attempt)
+
+	t := time.NewTimer(backoff)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-reqCtx.Done():
+		return reqCtx.Err()
+	}
+}
@@ -0,0 +1,110 @@
+package prom
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+const (
+	epFlags     = apiPrefix + "/status/flags"
+	epTSDBStats = apiPrefix + "/status/tsdb"
+)
+
+// apiResponse is the envelope common to all Prometheus API responses
+type apiResponse struct {
+	Status    string          `json:"status"`
+	Data      json.RawMessage `json:"data"`
+	ErrorType string          `json:"errorType"`
+	Error     string          `json:"error"`
+	Warnings  []string        `json:"warnings"`
+}
+
+// TSDBStats contains cardinality statistics for the Prometheus TSDB head block
+type TSDBStats struct {
+	HeadStats                   TSDBHeadStats `json:"headStats"`
+	SeriesCountByMetricName     []TSDBStat    `json:"seriesCountByMetricName"`
+	LabelValueCountByLabelName  []TSDBStat    `json:"labelValueCountByLabelName"`
+	MemoryInBytesByLabelName    []TSDBStat    `json:"memoryInBytesByLabelName"`
+	SeriesCountByLabelValuePair []TSDBStat    `json:"seriesCountByLabelValuePair"`
+}
+
+// TSDBHeadStats contains totals for the TSDB head block. Timestamps are in
+// milliseconds since the epoch.
+type TSDBHeadStats struct {
+	NumSeries     uint64 `json:"numSeries"`
+	NumLabelPairs int    `json:"numLabelPairs"`
+	ChunkCount    int64  `json:"chunkCount"`
+	MinTime       int64  `json:"minTime"`
+	MaxTime       int64  `json:"maxTime"`
+}
+
+// TSDBStat is a single named count, e.g. the number of series for a metric name
+type TSDBStat struct {
+	Name  string `json:"name"`
+	Value uint64 `json:"value"`
+}
+
+// TSDBStats returns the head block cardinality statistics of the Prometheus
+// server; i.e. the top metric names by series count, label names by value
+// count, etc. The statistics cover every series, and cannot be restricted, so
+// an error is returned if the Context injects label matchers.
+func (ctx *Context) TSDBStats() (*TSDBStats, error) {
+	if len(ctx.matchers) > 0 {
+		return nil, fmt.Errorf("TSDB stats cannot be restricted to the Context's label matchers")
+	}
+
+	var stats TSDBStats
+	err := ctx.status(epTSDBStats, &stats)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+// Flags returns the command-line flags the Prometheus server was started with,
+// mapped from flag name to value; e.g. "query.max-samples" to "50000000".
+func (ctx *Context) Flags() (map[string]string, error) {
+	flags := map[string]string{}
+	err := ctx.status(epFlags, &flags)
+	if err != nil {
+		return nil, err
+	}
+
+	return flags, nil
+}
+
+// status fetches the given status endpoint and decodes the data field of the
+// response into v
+func (ctx *Context) status(ep string, v interface{}) error {
+	// The status endpoints do not accept a POST
+	body, err := ctx.requestMethod(context.Background(), http.MethodGet, ep, "", nil)
+	if err != nil {
+		return err
+	}
+
+	return decodeAPIResponse(ep, body, v)
+}
+
+// decodeAPIResponse decodes the data field of the response body into v, or
+// returns the error reported by Prometheus
+func decodeAPIResponse(ep string, body []byte, v interface{}) error {
+	var resp apiResponse
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		return fmt.Errorf("Error %s fetching %s", err.Error(), ep)
+	}
+
+	if resp.Status == "error" {
+		return fmt.Errorf("Error %w fetching %s", &APIError{ErrorType: resp.ErrorType, Message: resp.Error}, ep)
+	}
+
+	err = json.Unmarshal(resp.Data, v)
+	if err != nil {
+		return fmt.Errorf("Error %s parsing %s", err.Error(), ep)
+	}
+
+	return nil
+}
@@ -0,0 +1,21 @@
+package prom_test
+
+import (
+	"testing"
+
+	"github.com/kubecost/cost-model/pkg/prom"
+	"github.com/kubecost/cost-model/pkg/prom/promtest"
+)
+
+func TestTSDBStatsWithLabelMatcher(t *testing.T) {
+	c := promtest.NewClient()
+	ctx := prom.NewContext(c, prom.WithLabelMatcher("tenant", "a"))
+
+	_, err := ctx.TSDBStats()
+	if err == nil {
+		t.Errorf("expected error fetching TSDB stats with a label matcher")
+	}
+	if len(c.Requests()) != 0 {
+		t.Errorf("expected no requests; got %+v", c.Requests())
+	}
+}
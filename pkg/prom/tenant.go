@@ -0,0 +1,151 @@
+package prom
+
+import (
+	"context"
+	"sync"
+
+	"github.com/kubecost/cost-model/pkg/util"
+)
+
+// tenantKey is the context key under which the tenant of a request is stored
+type tenantKey struct{}
+
+// WithTenant returns a copy of the context which attributes the queries run
+// with it, e.g. by QueryContext, to the given tenant, so that they are limited
+// by the Context's per-tenant concurrency. See SetTenantConcurrency.
+func WithTenant(reqCtx context.Context, tenant string) context.Context {
+	return context.WithValue(reqCtx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant attributed to the context by
+// WithTenant, if any
+func TenantFromContext(reqCtx context.Context) (string, bool) {
+	tenant, ok := reqCtx.Value(tenantKey{}).(string)
+	return tenant, ok
+}
+
+// tenantSemaphores holds a semaphore for each tenant with requests holding or
+// waiting for access, all sharing the same limit. A tenant's semaphore is
+// discarded once it has no holders or waiters, so that the number held is
+// bounded by the number of requests in flight rather than of tenants seen.
+type tenantSemaphores struct {
+	m          sync.Mutex
+	max        int
+	semaphores map[string]*tenantSemaphore
+}
+
+// tenantSemaphore is the semaphore of a tenant, and the number of requests
+// holding or waiting for access to it
+type tenantSemaphore struct {
+	sem  *util.Semaphore
+	refs int
+}
+
+// get returns the semaphore of the tenant, creating it if necessary, or nil if
+// per-tenant limits are disabled. Every semaphore returned must be passed to
+// put once the request no longer holds or waits for access to it.
+func (ts *tenantSemaphores) get(tenant string) *tenantSemaphore {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+
+	if ts.max <= 0 {
+		return nil
+	}
+
+	tsem, ok := ts.semaphores[tenant]
+	if !ok {
+		if ts.semaphores == nil {
+			ts.semaphores = map[string]*tenantSemaphore{}
+		}
+		tsem = &tenantSemaphore{sem: util.NewSemaphore(ts.max)}
+		ts.semaphores[tenant] = tsem
+	}
+	tsem.refs++
+
+	return tsem
+}
+
+// put releases a reference to the tenant's semaphore returned by get,
+// discarding the semaphore if it was the last
+func (ts *tenantSemaphores) put(tenant string, tsem *tenantSemaphore) {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+
+	tsem.refs--
+	if tsem.refs == 0 && ts.semaphores[tenant] == tsem {
+		delete(ts.semaphores, tenant)
+	}
+}
+
+func (ts *tenantSemaphores) setMax(max int) {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+
+	ts.max = max
+	if max <= 0 {
+		// Requests holding or waiting on a discarded semaphore still return
+		// access to it, and no longer contend with new requests
+		ts.semaphores = nil
+		return
+	}
+
+	for _, tsem := range ts.semaphores {
+		tsem.sem.SetMax(max)
+	}
+}
+
+// TenantConcurrency returns the maximum number of queries the Context will run
+// concurrently for any one tenant, or zero if there is no per-tenant limit
+func (ctx *Context) TenantConcurrency() int {
+	ctx.tenants.m.Lock()
+	defer ctx.tenants.m.Unlock()
+
+	return ctx.tenants.max
+}
+
+// SetTenantConcurrency sets the maximum number of queries the Context will run
+// concurrently for each tenant, as attributed to requests with WithTenant, so
+// that one tenant's queries cannot take every slot allowed by MaxConcurrency,
+// which continues to limit the total. Queries without a tenant are limited
+// only by MaxConcurrency. Zero or less disables per-tenant limits. It is safe
+// to call while queries are running.
+func (ctx *Context) SetTenantConcurrency(max int) {
+	ctx.tenants.setMax(max)
+}
+
+// acquire waits for access for the request, first from the semaphore of its
+// tenant, if any, then from the Context's, returning a function which returns
+// access to both. If the context is done first, its error is returned.
+func (ctx *Context) acquire(reqCtx context.Context) (func(), error) {
+	tenant, ok := TenantFromContext(reqCtx)
+
+	var tsem *tenantSemaphore
+	if ok {
+		tsem = ctx.tenants.get(tenant)
+	}
+
+	if tsem != nil {
+		err := tsem.sem.AcquireContext(reqCtx)
+		if err != nil {
+			ctx.tenants.put(tenant, tsem)
+			return nil, err
+		}
+	}
+
+	err := ctx.semaphore.AcquireContext(reqCtx)
+	if err != nil {
+		if tsem != nil {
+			tsem.sem.Return()
+			ctx.tenants.put(tenant, tsem)
+		}
+		return nil, err
+	}
+
+	return func() {
+		ctx.semaphore.Return()
+		if tsem != nil {
+			tsem.sem.Return()
+			ctx.tenants.put(tenant, tsem)
+		}
+	}, nil
+}
@@ -0,0 +1,73 @@
+package prom
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	prometheus "github.com/prometheus/client_golang/api"
+)
+
+// emptyClient responds to every request with an empty vector
+type emptyClient struct{}
+
+func (emptyClient) URL(ep string, args map[string]string) *url.URL {
+	return &url.URL{Scheme: "http", Host: "prometheus", Path: ep}
+}
+
+func (emptyClient) Do(ctx context.Context, req *http.Request) (*http.Response, []byte, prometheus.Warnings, error) {
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": []string{"application/json"}}}
+	return resp, []byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`), nil, nil
+}
+
+func TestTenantSemaphoresDiscardedWhenIdle(t *testing.T) {
+	ctx := NewContext(emptyClient{})
+	ctx.SetTenantConcurrency(2)
+
+	chs := []QueryResultsChan{}
+	for i := 0; i < 100; i++ {
+		reqCtx := WithTenant(context.Background(), fmt.Sprintf("tenant-%d", i%10))
+		chs = append(chs, ctx.QueryContext(reqCtx, "up"))
+	}
+	for _, ch := range chs {
+		qr := ch.AwaitResults()
+		if qr.Error != nil {
+			t.Fatalf("unexpected error: %s", qr.Error)
+		}
+	}
+
+	ctx.tenants.m.Lock()
+	defer ctx.tenants.m.Unlock()
+	if n := len(ctx.tenants.semaphores); n != 0 {
+		t.Errorf("expected no tenant semaphores once idle; got %d", n)
+	}
+}
+
+func TestTenantSemaphoreKeptWhileHeld(t *testing.T) {
+	ctx := NewContext(emptyClient{})
+	ctx.SetTenantConcurrency(1)
+
+	reqCtx := WithTenant(context.Background(), "a")
+	release, err := ctx.acquire(reqCtx)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// A second request for the tenant must wait on the same semaphore
+	waiting, cancel := context.WithTimeout(reqCtx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := ctx.acquire(waiting); err == nil {
+		t.Errorf("expected the tenant's limit to apply while access is held")
+	}
+
+	release()
+
+	ctx.tenants.m.Lock()
+	defer ctx.tenants.m.Unlock()
+	if n := len(ctx.tenants.semaphores); n != 0 {
+		t.Errorf("expected no tenant semaphores once released; got %d", n)
+	}
+}
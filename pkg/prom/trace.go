@@ -0,0 +1,110 @@
+package prom
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// PhaseTimings contains the duration of each phase of a request, as recorded
+// when the Context's TraceTimings is set. Phases which did not occur, such as
+// the DNS lookup and connection of a request reusing an open connection, are
+// zero.
+type PhaseTimings struct {
+	// DNSLookup is the time spent resolving the backend's address
+	DNSLookup time.Duration
+	// Connect is the time spent establishing a connection to the backend
+	Connect time.Duration
+	// TLSHandshake is the time spent negotiating TLS with the backend
+	TLSHandshake time.Duration
+	// TimeToFirstByte is the time from the start of the request until the
+	// first byte of the response was received, including the phases above
+	TimeToFirstByte time.Duration
+	// ServerProcessing is the time from the request being written until the
+	// first byte of the response was received; i.e. the time spent waiting on
+	// the backend
+	ServerProcessing time.Duration
+	// Total is the time from the start of the request until the response was
+	// read
+	Total time.Duration
+	// ReusedConnection is true if the request was sent over an idle
+	// connection, rather than a new one
+	ReusedConnection bool
+}
+
+// phaseTracer records the times at which the phases of a request start and
+// end. Trace hooks may be called from multiple goroutines.
+type phaseTracer struct {
+	m            sync.Mutex
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	reused       bool
+}
+
+// record sets the time to now
+func (pt *phaseTracer) record(t *time.Time) {
+	pt.m.Lock()
+	defer pt.m.Unlock()
+
+	*t = time.Now()
+}
+
+// trace returns a ClientTrace which records the phases of the request
+func (pt *phaseTracer) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { pt.record(&pt.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { pt.record(&pt.dnsDone) },
+		ConnectStart: func(string, string) {
+			// Only the first of multiple connection attempts is timed from
+			pt.m.Lock()
+			if pt.connectStart.IsZero() {
+				pt.connectStart = time.Now()
+			}
+			pt.m.Unlock()
+		},
+		ConnectDone:       func(string, string, error) { pt.record(&pt.connectDone) },
+		TLSHandshakeStart: func() { pt.record(&pt.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { pt.record(&pt.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			pt.m.Lock()
+			pt.reused = info.Reused
+			pt.m.Unlock()
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { pt.record(&pt.wroteRequest) },
+		GotFirstResponseByte: func() { pt.record(&pt.firstByte) },
+	}
+}
+
+// timings returns the durations of the phases of a request which started and
+// ended at the given times
+func (pt *phaseTracer) timings(start, end time.Time) *PhaseTimings {
+	pt.m.Lock()
+	defer pt.m.Unlock()
+
+	return &PhaseTimings{
+		DNSLookup:        between(pt.dnsStart, pt.dnsDone),
+		Connect:          between(pt.connectStart, pt.connectDone),
+		TLSHandshake:     between(pt.tlsStart, pt.tlsDone),
+		TimeToFirstByte:  between(start, pt.firstByte),
+		ServerProcessing: between(pt.wroteRequest, pt.firstByte),
+		Total:            end.Sub(start),
+		ReusedConnection: pt.reused,
+	}
+}
+
+// between returns the duration from start to end, or zero if either did not
+// occur
+func between(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return 0
+	}
+
+	return end.Sub(start)
+}
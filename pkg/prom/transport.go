@@ -0,0 +1,299 @@
+package prom
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultDialTimeout is the dial timeout of a transport built by
+	// NewRoundTripper, as used by the Prometheus client
+	DefaultDialTimeout = 30 * time.Second
+	// DefaultTLSHandshakeTimeout is the TLS handshake timeout of a transport
+	// built by NewRoundTripper, as used by the Prometheus client
+	DefaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+// TransportOption configures the RoundTripper built by NewRoundTripper
+type TransportOption func(*transportConfig)
+
+// transportConfig describes the transport built by NewRoundTripper
+type transportConfig struct {
+	unixSocket            string
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	timeout               time.Duration
+}
+
+// WithUnixSocket configures the RoundTripper to send all requests over the
+// Unix domain socket at the given path. The host of the client's address is
+// ignored, so any placeholder, e.g. http://prometheus, may be used.
+func WithUnixSocket(path string) TransportOption {
+	return func(tc *transportConfig) {
+		tc.unixSocket = path
+	}
+}
+
+// WithDialTimeout configures the RoundTripper to fail requests which take
+// longer than the given duration to connect to the backend with a
+// TimeoutError in the TimeoutDial phase. Defaults to DefaultDialTimeout.
+func WithDialTimeout(d time.Duration) TransportOption {
+	return func(tc *transportConfig) {
+		tc.dialTimeout = d
+	}
+}
+
+// WithTLSHandshakeTimeout configures the RoundTripper to fail requests which
+// take longer than the given duration to negotiate TLS with a TimeoutError in
+// the TimeoutTLSHandshake phase. Defaults to DefaultTLSHandshakeTimeout, or
+// to the timeout of the base transport, if any.
+func WithTLSHandshakeTimeout(d time.Duration) TransportOption {
+	return func(tc *transportConfig) {
+		tc.tlsHandshakeTimeout = d
+	}
+}
+
+// WithResponseHeaderTimeout configures the RoundTripper to fail requests whose
+// response headers are not received within the given duration of the request
+// being written with a TimeoutError in the TimeoutResponseHeader phase. By
+// default, there is no response header timeout, or that of the base
+// transport, if any.
+func WithResponseHeaderTimeout(d time.Duration) TransportOption {
+	return func(tc *transportConfig) {
+		tc.responseHeaderTimeout = d
+	}
+}
+
+// WithTimeout configures the RoundTripper to fail requests which do not
+// complete, including reading the response, within the given duration with a
+// TimeoutError in the TimeoutOverall phase. By default, there is no overall
+// timeout. Time spent waiting for access to the Context is not included.
+func WithTimeout(d time.Duration) TransportOption {
+	return func(tc *transportConfig) {
+		tc.timeout = d
+	}
+}
+
+// NewRoundTripper returns an http.RoundTripper applying the given options, to
+// be passed as the RoundTripper of the prometheus.Config of the client given
+// to NewContext. Requests exceeding a configured timeout fail with a
+// TimeoutError. Responses are requested with gzip compression and decoded by
+// the RoundTripper itself, which tolerates proxies which declare gzip
+// encoding for uncompressed bodies.
+//
+// Requests are sent with base, or if it is nil, with a transport with the
+// defaults of the Prometheus client. An *http.Transport base is cloned, keeping
+// its TLS, proxy and connection settings, with its dialer replaced by one
+// applying WithDialTimeout and WithUnixSocket. Any other base, such as one
+// adding authentication, is wrapped as is, so only WithTimeout may be given
+// with it, and an error is returned for the other options; to combine them,
+// wrap the RoundTripper returned for a nil or *http.Transport base instead.
+func NewRoundTripper(base http.RoundTripper, opts ...TransportOption) (http.RoundTripper, error) {
+	tc := &transportConfig{}
+	for _, opt := range opts {
+		opt(tc)
+	}
+
+	var next http.RoundTripper
+	switch t := base.(type) {
+	case nil:
+		next = tc.transport(&http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSHandshakeTimeout: DefaultTLSHandshakeTimeout,
+		})
+	case *http.Transport:
+		next = tc.transport(t.Clone())
+	default:
+		if tc.unixSocket != "" || tc.dialTimeout > 0 || tc.tlsHandshakeTimeout > 0 || tc.responseHeaderTimeout > 0 {
+			return nil, fmt.Errorf("only WithTimeout may be applied to a %T; wrap a RoundTripper built for an *http.Transport instead", base)
+		}
+		next = base
+	}
+
+	return &roundTripper{next: next, config: tc}, nil
+}
+
+// transport configures the given transport as described by the configuration,
+// for requests sent by the roundTripper
+func (tc *transportConfig) transport(t *http.Transport) *http.Transport {
+	dialTimeout := tc.dialTimeoutOrDefault()
+
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		if tc.unixSocket != "" {
+			network, address = "unix", tc.unixSocket
+		}
+
+		conn, err := dialer.DialContext(ctx, network, address)
+
+		// Timeouts of the dialer itself are distinguished from the request's
+		// context expiring, which is classified by the roundTripper
+		var ne net.Error
+		if err != nil && ctx.Err() == nil && errors.As(err, &ne) && ne.Timeout() {
+			return nil, &TimeoutError{Phase: TimeoutDial, Timeout: dialTimeout, Err: err}
+		}
+		return conn, err
+	}
+
+	t.Dial = nil
+	t.DialTLS = nil
+	t.DialContext = dial
+	if tc.tlsHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = tc.tlsHandshakeTimeout
+	}
+	if tc.responseHeaderTimeout > 0 {
+		t.ResponseHeaderTimeout = tc.responseHeaderTimeout
+	}
+
+	// Timeouts kept from the transport are classified as configured ones are
+	tc.tlsHandshakeTimeout = t.TLSHandshakeTimeout
+	tc.responseHeaderTimeout = t.ResponseHeaderTimeout
+	// Compressed responses are decoded by the roundTripper, which tolerates
+	// proxies which mislabel uncompressed responses
+	t.DisableCompression = true
+
+	if tc.unixSocket != "" {
+		// Requests never leave the host, so proxies must not apply
+		t.Proxy = nil
+	}
+
+	return t
+}
+
+func (tc *transportConfig) dialTimeoutOrDefault() time.Duration {
+	if tc.dialTimeout <= 0 {
+		return DefaultDialTimeout
+	}
+	return tc.dialTimeout
+}
+
+// Phases of a request, as tracked by requestPhase
+const (
+	phaseConnecting int32 = iota
+	phaseTLSHandshake
+	phaseAwaitingResponse
+	phaseReadingResponse
+)
+
+// requestPhase tracks the phase a request has reached, so that a timeout can
+// be attributed to the phase in which it occurred
+type requestPhase struct {
+	phase int32
+}
+
+func (rp *requestPhase) set(phase int32) {
+	atomic.StoreInt32(&rp.phase, phase)
+}
+
+func (rp *requestPhase) get() int32 {
+	return atomic.LoadInt32(&rp.phase)
+}
+
+// trace returns a ClientTrace which updates the phase as the request proceeds
+func (rp *requestPhase) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn:              func(string) { rp.set(phaseConnecting) },
+		TLSHandshakeStart:    func() { rp.set(phaseTLSHandshake) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { rp.set(phaseAwaitingResponse) },
+		GotFirstResponseByte: func() { rp.set(phaseReadingResponse) },
+	}
+}
+
+// roundTripper sends requests with the next RoundTripper, applying the
+// overall timeout, classifying timeouts by the phase in which they occurred,
+// and decoding compressed responses
+type roundTripper struct {
+	next   http.RoundTripper
+	config *transportConfig
+}
+
+// RoundTrip sends the request, reading the whole body of the response within
+// the overall timeout, if any, so that a slow response cannot outlast it. The
+// returned response carries the decoded body.
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	reqCtx := ctx
+	if rt.config.timeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(ctx, rt.config.timeout)
+		defer cancel()
+	}
+
+	phase := &requestPhase{}
+	req = req.WithContext(httptrace.WithClientTrace(reqCtx, phase.trace()))
+
+	// Setting the header explicitly leaves compressed responses encoded, even
+	// by a base transport which does not disable compression, so that they
+	// can be decoded tolerantly
+	if req.Header.Get("Accept-Encoding") == "" {
+		req.Header = req.Header.Clone()
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil {
+		return nil, rt.timeoutError(ctx, reqCtx, phase, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, rt.timeoutError(ctx, reqCtx, phase, err)
+	}
+
+	body, err = decodeContentEncoding(resp, body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return resp, nil
+}
+
+// timeoutError returns a TimeoutError for the phase in which the request timed
+// out, if the error is due to a configured timeout, or the error otherwise
+func (rt *roundTripper) timeoutError(ctx, reqCtx context.Context, phase *requestPhase, err error) error {
+	tc := rt.config
+
+	// The overall timeout expired, rather than the caller's own deadline
+	if tc.timeout > 0 && reqCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return &TimeoutError{Phase: TimeoutOverall, Timeout: tc.timeout, Err: err}
+	}
+
+	var te *TimeoutError
+	if errors.As(err, &te) {
+		return err
+	}
+
+	var ne net.Error
+	if ctx.Err() != nil || !errors.As(err, &ne) || !ne.Timeout() {
+		return err
+	}
+
+	switch phase.get() {
+	case phaseTLSHandshake:
+		if tc.tlsHandshakeTimeout > 0 {
+			return &TimeoutError{Phase: TimeoutTLSHandshake, Timeout: tc.tlsHandshakeTimeout, Err: err}
+		}
+	case phaseAwaitingResponse:
+		if tc.responseHeaderTimeout > 0 {
+			return &TimeoutError{Phase: TimeoutResponseHeader, Timeout: tc.responseHeaderTimeout, Err: err}
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,232 @@
+package prom_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kubecost/cost-model/pkg/prom"
+	"github.com/kubecost/cost-model/pkg/prom/promtest"
+	prometheus "github.com/prometheus/client_golang/api"
+)
+
+// newTestContext returns a Context whose client sends requests to the address
+// with the given RoundTripper
+func newTestContext(t *testing.T, address string, rt http.RoundTripper) *prom.Context {
+	t.Helper()
+
+	client, err := prometheus.NewClient(prometheus.Config{Address: address, RoundTripper: rt})
+	if err != nil {
+		t.Fatalf("unexpected error creating client: %s", err)
+	}
+
+	return prom.NewContext(client)
+}
+
+func respondEmptyVector(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(promtest.EmptyVector))
+}
+
+func TestRoundTripperUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "prometheus.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(respondEmptyVector)}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	rt, err := prom.NewRoundTripper(nil, prom.WithUnixSocket(socket))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	qr := newTestContext(t, "http://prometheus", rt).Query("up").AwaitResults()
+	if qr.Error != nil {
+		t.Errorf("unexpected error: %s", qr.Error)
+	}
+}
+
+func TestRoundTripperTimeouts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		respondEmptyVector(w, r)
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		name  string
+		opt   prom.TransportOption
+		phase prom.TimeoutPhase
+	}{
+		{"overall", prom.WithTimeout(20 * time.Millisecond), prom.TimeoutOverall},
+		{"response header", prom.WithResponseHeaderTimeout(20 * time.Millisecond), prom.TimeoutResponseHeader},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rt, err := prom.NewRoundTripper(nil, c.opt)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			qr := newTestContext(t, srv.URL, rt).Query("up").AwaitResults()
+
+			var te *prom.TimeoutError
+			if !errors.As(qr.Error, &te) {
+				t.Fatalf("expected TimeoutError; got %v", qr.Error)
+			}
+			if te.Phase != c.phase {
+				t.Errorf("expected %s timeout; got %s", c.phase, te.Phase)
+			}
+		})
+	}
+}
+
+func TestRoundTripperRecordingClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(respondEmptyVector))
+	defer srv.Close()
+
+	rt, err := prom.NewRoundTripper(nil, prom.WithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	client, err := prometheus.NewClient(prometheus.Config{Address: srv.URL, RoundTripper: rt})
+	if err != nil {
+		t.Fatalf("unexpected error creating client: %s", err)
+	}
+
+	var buf bytes.Buffer
+	rc := prom.NewRecordingClient(client, &buf)
+
+	qr := prom.NewContext(rc).Query("up").AwaitResults()
+	if qr.Error != nil {
+		t.Fatalf("unexpected error: %s", qr.Error)
+	}
+	if rc.Err() != nil {
+		t.Fatalf("unexpected recording error: %s", rc.Err())
+	}
+	if buf.Len() == 0 {
+		t.Errorf("expected the request to be recorded")
+	}
+}
+
+// bearerRoundTripper adds a bearer token to every request sent with next
+type bearerRoundTripper struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (b bearerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	return b.next.RoundTrip(req)
+}
+
+func TestRoundTripperWrapsBase(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("query") == "slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		respondEmptyVector(w, r)
+	}))
+	defer srv.Close()
+
+	base := bearerRoundTripper{token: "secret", next: http.DefaultTransport}
+	rt, err := prom.NewRoundTripper(base, prom.WithTimeout(20*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ctx := newTestContext(t, srv.URL, rt)
+
+	qr := ctx.Query("up").AwaitResults()
+	if qr.Error != nil {
+		t.Errorf("unexpected error: %s", qr.Error)
+	}
+
+	qr = ctx.Query("slow").AwaitResults()
+	var te *prom.TimeoutError
+	if !errors.As(qr.Error, &te) || te.Phase != prom.TimeoutOverall {
+		t.Errorf("expected overall TimeoutError; got %v", qr.Error)
+	}
+}
+
+func TestRoundTripperBaseTransport(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(respondEmptyVector))
+	defer srv.Close()
+
+	// The server's certificate is only trusted by its own client's transport
+	base := srv.Client().Transport.(*http.Transport)
+	rt, err := prom.NewRoundTripper(base, prom.WithDialTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	qr := newTestContext(t, srv.URL, rt).Query("up").AwaitResults()
+	if qr.Error != nil {
+		t.Errorf("unexpected error: %s", qr.Error)
+	}
+}
+
+func TestRoundTripperRejectsTransportOptionsForWrappedBase(t *testing.T) {
+	base := bearerRoundTripper{token: "secret", next: http.DefaultTransport}
+
+	_, err := prom.NewRoundTripper(base, prom.WithDialTimeout(time.Second))
+	if err == nil {
+		t.Errorf("expected error applying a dial timeout to a wrapped RoundTripper")
+	}
+}
+
+func TestRoundTripperContentEncoding(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(promtest.EmptyVector))
+	zw.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+
+		// A proxy which declares gzip encoding without compressing the body
+		if r.URL.Query().Get("query") == "mislabeled" {
+			w.Write([]byte(promtest.EmptyVector))
+			return
+		}
+		w.Write(compressed.Bytes())
+	}))
+	defer srv.Close()
+
+	rt, err := prom.NewRoundTripper(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ctx := newTestContext(t, srv.URL, rt)
+
+	for _, q := range []string{"compressed", "mislabeled"} {
+		qr := ctx.Query(q).AwaitResults()
+		if qr.Error != nil {
+			t.Errorf("unexpected error for %s response: %s", q, qr.Error)
+		}
+	}
+}
@@ -1,25 +1,129 @@
 package util
 
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
 // Semaphore implements a non-weighted semaphore for restricting
-// concurrent access to a limited number of processes.
+// concurrent access to a limited number of processes. Callers are
+// granted access in the order in which they called Acquire.
 type Semaphore struct {
-	s chan bool
+	m       sync.Mutex
+	max     int
+	count   int
+	waiters list.List
 }
 
 // Acquire blocks until access can be granted to the caller
 func (s *Semaphore) Acquire() {
-	s.s <- true
+	s.m.Lock()
+	if s.count < s.max && s.waiters.Len() == 0 {
+		s.count++
+		s.m.Unlock()
+		return
+	}
+
+	ready := make(chan struct{})
+	s.waiters.PushBack(ready)
+	s.m.Unlock()
+
+	<-ready
+}
+
+// AcquireContext blocks until access can be granted to the caller, or the
+// context is done, in which case the caller is removed from the queue and the
+// context's error is returned. Access must only be returned on success.
+func (s *Semaphore) AcquireContext(ctx context.Context) error {
+	s.m.Lock()
+	if s.count < s.max && s.waiters.Len() == 0 {
+		s.count++
+		s.m.Unlock()
+		return nil
+	}
+
+	ready := make(chan struct{})
+	elem := s.waiters.PushBack(ready)
+	s.m.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	// Access may have been granted while waiting for the lock, in which case
+	// it must be passed on rather than leaked
+	select {
+	case <-ready:
+		s.release()
+	default:
+		s.waiters.Remove(elem)
+	}
+
+	return ctx.Err()
 }
 
 // Return releases access from the caller, opening it for acquisition
 func (s *Semaphore) Return() {
-	<-s.s
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.release()
+}
+
+// release returns access while holding the lock
+func (s *Semaphore) release() {
+	// Hand access directly to the longest waiting caller, if any, so that
+	// newly arriving callers cannot jump the queue. If the max has been
+	// lowered below the current count, access is not handed off.
+	if front := s.waiters.Front(); front != nil && s.count <= s.max {
+		s.waiters.Remove(front)
+		close(front.Value.(chan struct{}))
+		return
+	}
+
+	s.count--
+}
+
+// Max returns the number of concurrent accesses currently allowed
+func (s *Semaphore) Max() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.max
+}
+
+// SetMax changes the number of concurrent accesses allowed. Raising the max
+// immediately grants access to waiting callers, up to the new max. Lowering
+// the max does not revoke access, but withholds it from waiting callers until
+// enough accesses have been returned.
+func (s *Semaphore) SetMax(max int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.max = max
+
+	for s.count < s.max {
+		front := s.waiters.Front()
+		if front == nil {
+			break
+		}
+
+		s.waiters.Remove(front)
+		close(front.Value.(chan struct{}))
+		s.count++
+	}
 }
 
 // NewSemaphore creates a new Semaphore that allows max number of
 // concurrent access
 func NewSemaphore(max int) *Semaphore {
 	return &Semaphore{
-		s: make(chan bool, max),
+		max: max,
 	}
 }
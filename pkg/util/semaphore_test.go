@@ -0,0 +1,154 @@
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waitForWaiters blocks until n callers are queued on the semaphore
+func waitForWaiters(t *testing.T, s *Semaphore, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		s.m.Lock()
+		queued := s.waiters.Len()
+		s.m.Unlock()
+
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("timed out waiting for %d queued callers", n)
+}
+
+// expectState fails the test unless count access is held with n queued callers
+func expectState(t *testing.T, s *Semaphore, count, n int) {
+	t.Helper()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.count != count || s.waiters.Len() != n {
+		t.Errorf("expected count %d with %d queued; got count %d with %d queued", count, n, s.count, s.waiters.Len())
+	}
+}
+
+// expectGranted fails the test unless exactly n grants are received on the
+// channel within a short wait
+func expectGranted(t *testing.T, granted chan int, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-granted:
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d grants; got %d", n, i)
+		}
+	}
+
+	select {
+	case <-granted:
+		t.Fatalf("expected only %d grants", n)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestSemaphoreFIFO(t *testing.T) {
+	s := NewSemaphore(1)
+	s.Acquire()
+
+	const n = 10
+	order := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			s.Acquire()
+			order <- i
+		}(i)
+		waitForWaiters(t, s, i+1)
+	}
+
+	for i := 0; i < n; i++ {
+		s.Return()
+		if got := <-order; got != i {
+			t.Fatalf("expected caller %d to be granted access next; got %d", i, got)
+		}
+	}
+
+	s.Return()
+	expectState(t, s, 0, 0)
+}
+
+func TestSemaphoreCanceledWaiterRacingGrant(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		s := NewSemaphore(1)
+		s.Acquire()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		result := make(chan error, 1)
+		go func() {
+			result <- s.AcquireContext(ctx)
+		}()
+		waitForWaiters(t, s, 1)
+
+		// The grant and the cancellation race; either way, access must be
+		// neither leaked nor granted twice
+		go cancel()
+		s.Return()
+
+		if err := <-result; err == nil {
+			s.Return()
+		}
+		expectState(t, s, 0, 0)
+	}
+}
+
+func TestSemaphoreSetMaxWhileHeld(t *testing.T) {
+	t.Run("lowered", func(t *testing.T) {
+		s := NewSemaphore(2)
+		s.Acquire()
+		s.Acquire()
+		s.SetMax(1)
+
+		granted := make(chan int, 1)
+		go func() {
+			s.Acquire()
+			granted <- 0
+		}()
+		waitForWaiters(t, s, 1)
+
+		// The first access returned only brings the count down to the max
+		s.Return()
+		expectGranted(t, granted, 0)
+		expectState(t, s, 1, 1)
+
+		s.Return()
+		expectGranted(t, granted, 1)
+		expectState(t, s, 1, 0)
+	})
+
+	t.Run("raised", func(t *testing.T) {
+		s := NewSemaphore(1)
+		s.Acquire()
+
+		granted := make(chan int, 3)
+		for i := 0; i < 3; i++ {
+			go func() {
+				s.Acquire()
+				granted <- 0
+			}()
+		}
+		waitForWaiters(t, s, 3)
+
+		s.SetMax(3)
+		expectGranted(t, granted, 2)
+		expectState(t, s, 3, 1)
+
+		s.Return()
+		expectGranted(t, granted, 1)
+		expectState(t, s, 3, 0)
+	})
+}
@@ -40,6 +40,30 @@ func ParseDuration(duration string) (*time.Duration, error) {
 	return &dur, nil
 }
 
+// FormatDuration converts a Duration into a Prometheus-style duration string,
+// using the largest unit which represents the duration exactly; e.g. 90 seconds
+// is formatted as "90s", and 2 hours as "2h". Sub-second durations are
+// formatted in milliseconds.
+func FormatDuration(duration time.Duration) string {
+	units := []struct {
+		suffix string
+		unit   time.Duration
+	}{
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	}
+
+	for _, u := range units {
+		if duration%u.unit == 0 {
+			return fmt.Sprintf("%d%s", duration/u.unit, u.suffix)
+		}
+	}
+
+	return fmt.Sprintf("%dms", duration/time.Millisecond)
+}
+
 // ParseTimeRange returns a start and end time, respectively, which are converted from
 // a duration and offset, defined as strings with Prometheus-style syntax.
 func ParseTimeRange(duration, offset string) (*time.Time, *time.Time, error) {